@@ -2,11 +2,24 @@ package secretsejson
 
 import (
 	"context"
+	"strings"
+	"sync"
+	"time"
 
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
+// walRollbackMinAge is how long a document write may take before its WAL
+// entry is considered abandoned and replayed.
+const walRollbackMinAge = 1 * time.Minute
+
+// decryptedCacheSize is the number of documents kept decrypted in memory when
+// the mount uses lazy decryption.
+const decryptedCacheSize = 256
+
 // Factory returns a new backend as logical.Backend.
 func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend, error) {
 	b := Backend()
@@ -32,6 +45,14 @@ func FactoryType(backendType logical.BackendType) logical.Factory {
 // Backend returns a private embedded struct of framework.Backend.
 func Backend() *backend {
 	var b backend
+	b.locks = locksutil.CreateLocks()
+	b.keyUsage = map[string]*keyUsage{}
+	b.rotationJobs = map[string]bool{}
+	b.jobsCtx, b.cancelJobs = context.WithCancel(context.Background())
+	// lru.New only fails for a non-positive size
+	b.decryptedCache, _ = lru.New(decryptedCacheSize)
+	documentPaths := ejsonPaths(&b)
+	b.documentsPath = documentPaths[0]
 	b.Backend = &framework.Backend{
 		Help: "",
 		Paths: framework.PathAppend(
@@ -40,15 +61,91 @@ func Backend() *backend {
 			ejsonAnalysePaths(&b),
 			ejsonIdentityPath(&b),
 			ejsonDecryptPaths(&b),
+			ejsonEncryptPaths(&b),
+			ejsonValidatePaths(&b),
+			ejsonRotateDocumentsPaths(&b),
 			ejsonKeysPaths(&b),
-			ejsonPaths(&b),
+			ejsonConfigPaths(&b),
+			ejsonConsistencyPaths(&b),
+			ejsonFieldPaths(&b),
+			ejsonVersionsPaths(&b),
+			ejsonDeletePaths(&b),
+			ejsonPatchPaths(&b),
+			ejsonMetadataPaths(&b),
+			documentPaths,
 		),
-		Secrets:     []*framework.Secret{},
-		BackendType: logical.TypeLogical,
+		Secrets:           []*framework.Secret{},
+		BackendType:       logical.TypeLogical,
+		InitializeFunc:    b.initialize,
+		PeriodicFunc:      b.periodic,
+		Invalidate:        b.invalidate,
+		Clean:             b.clean,
+		WALRollback:       b.walRollback,
+		WALRollbackMinAge: walRollbackMinAge,
 	}
 	return &b
 }
 
 type backend struct {
 	*framework.Backend
+
+	// documentsPath is the catch-all path serving documents by their name
+	documentsPath *framework.Path
+
+	// locks serialises writes to the same stored document
+	locks []*locksutil.LockEntry
+
+	// decryptedCache holds sanitized plaintext keyed by the storage key of
+	// its ciphertext, only used with lazy decryption
+	decryptedCache *lru.Cache
+
+	// keyUsage counts decryptions per public key until they are stored
+	keyUsage     map[string]*keyUsage
+	keyUsageLock sync.Mutex
+
+	// rotationJobs holds the bulk rotations being worked on by this node, and
+	// whether they were started again while being worked on
+	rotationJobs     map[string]bool
+	rotationJobsLock sync.Mutex
+
+	// jobsCtx is cancelled to stop background jobs when the backend shuts down
+	jobsCtx    context.Context
+	cancelJobs context.CancelFunc
+}
+
+// clean stops background jobs, which resume once the backend is started again.
+func (b *backend) clean(ctx context.Context) {
+	b.cancelJobs()
+}
+
+// invalidate drops cached plaintext when storage is changed by another node.
+func (b *backend) invalidate(ctx context.Context, key string) {
+	switch {
+	case key == configPath, strings.HasPrefix(key, "keys/"):
+		b.decryptedCache.Purge()
+	default:
+		b.decryptedCache.Remove(key)
+	}
+}
+
+// periodic stores the usage of keys, starts scheduled and resumes interrupted
+// bulk rotations and destroys soft deleted documents once their retention has
+// passed.
+func (b *backend) periodic(ctx context.Context, req *logical.Request) error {
+	if err := b.flushKeyUsage(ctx, req.Storage); err != nil {
+		return err
+	}
+	if err := b.scheduleRotations(ctx, req.Storage); err != nil {
+		return err
+	}
+	if err := b.resumeRotationJobs(ctx, req.Storage); err != nil {
+		return err
+	}
+	return b.purgeDeletedDocuments(ctx, req.Storage)
+}
+
+func (b *backend) lockDocument(path string) func() {
+	lock := locksutil.LockForKey(b.locks, path)
+	lock.Lock()
+	return lock.Unlock
 }
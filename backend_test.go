@@ -25,5 +25,10 @@ func getTestBackend(t *testing.T) (logical.Backend, logical.Storage) {
 		t.Fatalf("unable to create backend: %v", err)
 	}
 
+	// Vault initializes backends when mounting them
+	if err := b.Initialize(context.Background(), &logical.InitializationRequest{Storage: config.StorageView}); err != nil {
+		t.Fatalf("unable to initialize backend: %v", err)
+	}
+
 	return b, config.StorageView
 }
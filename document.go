@@ -0,0 +1,1231 @@
+package secretsejson
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	ej "github.com/Shopify/ejson/json"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/mitchellh/mapstructure"
+)
+
+// documentPrefix is the storage prefix below which all documents are kept,
+// apart from the keys and configuration of the backend.
+const documentPrefix = "docs/"
+
+// namespaceMigrationKey holds the progress of moving the documents of older
+// mounts below documentPrefix, see migrateDocumentNamespace.
+const namespaceMigrationKey = "namespace_migration"
+
+// reservedSegments cannot be used as a segment of a document name as they
+// address the entries and operations of a document.
+var reservedSegments = []string{"decrypted", "versions", "rollback", "metadata", "undelete", "destroy", "patch"}
+
+// reservedSuffixes cannot be the last segment of a document name with several
+// segments. On their own they remain valid names, reachable below docs/.
+var reservedSuffixes = []string{"rotate", "copy"}
+
+const (
+	walKindStoreDocument  = "store_document"
+	walKindDeleteDocument = "delete_document"
+	// walKindTombstoneDocument covers soft deletes and undeletes, which only
+	// change the current entries of a document.
+	walKindTombstoneDocument = "tombstone_document"
+)
+
+// documentWAL is written before the entries of a document are changed and
+// removed once all of them are in place. Entries left behind are replayed by
+// walRollback to bring the document back into a consistent state.
+type documentWAL struct {
+	Path    string `json:"path" mapstructure:"path"`
+	Version int    `json:"version" mapstructure:"version"`
+}
+
+// documentMetadata tracks the versions stored for a single ejson document.
+// It lives at <path>/metadata next to the current encrypted and decrypted
+// entries.
+type documentMetadata struct {
+	CurrentVersion int                      `json:"current_version"`
+	OldestVersion  int                      `json:"oldest_version"`
+	CreatedTime    time.Time                `json:"created_time"`
+	UpdatedTime    time.Time                `json:"updated_time"`
+	CreatedBy      *documentWriter          `json:"created_by"`
+	UpdatedBy      *documentWriter          `json:"updated_by"`
+	PublicKey      string                   `json:"public_key"`
+	Description    string                   `json:"description"`
+	Labels         map[string]string        `json:"labels"`
+	Versions       map[int]*versionMetadata `json:"versions"`
+	DeletedTime    time.Time                `json:"deleted_time"`
+	DeletedBy      *documentWriter          `json:"deleted_by"`
+}
+
+// deleted reports whether the document is soft deleted, its versions are kept
+// until it is undeleted or destroyed.
+func (m *documentMetadata) deleted() bool {
+	return !m.DeletedTime.IsZero()
+}
+
+type versionMetadata struct {
+	CreatedTime time.Time       `json:"created_time"`
+	CreatedBy   *documentWriter `json:"created_by"`
+	PublicKey   string          `json:"public_key"`
+	// RotatedFrom is the public key of the previous version when this version
+	// was written by rotating the document to a new key
+	RotatedFrom string `json:"rotated_from,omitempty"`
+}
+
+// documentWriter identifies the caller that wrote a document version.
+type documentWriter struct {
+	EntityID    string `json:"entity_id"`
+	DisplayName string `json:"display_name"`
+}
+
+func writerFromRequest(req *logical.Request) *documentWriter {
+	return &documentWriter{
+		EntityID:    req.EntityID,
+		DisplayName: req.DisplayName,
+	}
+}
+
+func (w *documentWriter) toMap() map[string]interface{} {
+	if w == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"entity_id":    w.EntityID,
+		"display_name": w.DisplayName,
+	}
+}
+
+// documentPublicKey returns the hex encoded _public_key of an ejson document.
+func documentPublicKey(encData []byte) (string, error) {
+	pubKey, err := ej.ExtractPublicKey(encData)
+	if err != nil {
+		return "", fmt.Errorf("failed to extract public key: %s", err)
+	}
+	return fmt.Sprintf("%x", pubKey), nil
+}
+
+// documentPattern returns the route pattern of a document operation. The
+// document name is captured as path and may be given with or without the
+// docs/ prefix, the latter for compatibility with mounts from before the
+// namespace existed.
+func documentPattern(name string, suffix string) string {
+	return fmt.Sprintf("(?:%s)?(?P<path>%s)%s", documentPrefix, name, suffix)
+}
+
+func documentKey(name string) string {
+	return documentPrefix + name
+}
+
+func documentName(key string) string {
+	return strings.TrimPrefix(key, documentPrefix)
+}
+
+// validateDocumentName rejects names that would collide with the entries or
+// operations of another document.
+func validateDocumentName(name string) error {
+	if name == "" {
+		return fmt.Errorf("no document name provided")
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" {
+			return fmt.Errorf("document name %q contains an empty segment", name)
+		}
+		for _, reserved := range reservedSegments {
+			if segment == reserved {
+				return fmt.Errorf("document name %q contains the reserved segment %q", name, reserved)
+			}
+		}
+	}
+	for _, reserved := range reservedSuffixes {
+		if strings.HasSuffix(name, "/"+reserved) {
+			return fmt.Errorf("document name %q ends with the reserved segment %q", name, reserved)
+		}
+	}
+	return nil
+}
+
+// checkDocumentPath rejects requests that do not address the document name by
+// its canonical path, so that each document has a single set of paths for
+// policies to grant or deny. Names clashing with an endpoint of the plugin are
+// addressed below docs/, all others without the prefix.
+func (b *backend) checkDocumentPath(req *logical.Request, name string) (*logical.Response, error) {
+	clashing := name == strings.TrimSuffix(documentPrefix, "/") ||
+		strings.HasPrefix(name, documentPrefix) ||
+		b.Route(name) != b.documentsPath
+	prefixed := strings.HasPrefix(req.Path, documentPrefix)
+
+	switch {
+	case prefixed && !clashing:
+		return logical.ErrorResponse(fmt.Sprintf("document %s must be addressed without the %s prefix", name, documentPrefix)), logical.ErrInvalidRequest
+	case !prefixed && clashing:
+		return logical.ErrorResponse(fmt.Sprintf("document %s must be addressed with the %s prefix", name, documentPrefix)), logical.ErrInvalidRequest
+	}
+	return nil, nil
+}
+
+func decryptedKey(path string) string {
+	return fmt.Sprintf("%s/decrypted", path)
+}
+
+func metadataKey(path string) string {
+	return fmt.Sprintf("%s/metadata", path)
+}
+
+func versionKey(path string, version int) string {
+	return fmt.Sprintf("%s/versions/%d", path, version)
+}
+
+// sanitizedPlaintext decrypts encData and returns the plaintext as it is
+// stored at <path>/decrypted, with keys normalised according to the
+// underscore policy of the mount.
+func (b *backend) sanitizedPlaintext(ctx context.Context, s logical.Storage, encData []byte) ([]byte, error) {
+	config, err := b.config(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	decBytes, err := b.decryptEjson(ctx, s, encData)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to decrypt ejson: {{err}}", err)
+	}
+	decData := map[string]interface{}{}
+	if err := json.Unmarshal(decBytes, &decData); err != nil {
+		return nil, errwrap.Wrapf("failed to decrypt ejson: {{err}}", err)
+	}
+	// Remove the _public_key key so it doesn't end up as a value
+	delete(decData, "_public_key")
+
+	// Strip underscores from key values before storing it decrypted for ease-of-access
+	switch config.underscorePolicy() {
+	case underscorePolicyTopLevel:
+		decData, err = StripUnderscores(decData, false)
+	case underscorePolicyAll:
+		decData, err = StripUnderscores(decData, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Marshal the sanitized values one last time so we can store it
+	sanData, err := json.Marshal(decData)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to marshall sanitized json: {{err}}", err)
+	}
+	return sanData, nil
+}
+
+// getDocumentMetadata returns the metadata stored for path, or nil if the
+// document has never been written with versioning.
+func getDocumentMetadata(ctx context.Context, s logical.Storage, path string) (*documentMetadata, error) {
+	entry, err := s.Get(ctx, metadataKey(path))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	meta := &documentMetadata{}
+	if err := entry.DecodeJSON(meta); err != nil {
+		return nil, errwrap.Wrapf("failed to decode document metadata: {{err}}", err)
+	}
+	if meta.Versions == nil {
+		meta.Versions = map[int]*versionMetadata{}
+	}
+	if meta.Labels == nil {
+		meta.Labels = map[string]string{}
+	}
+	return meta, nil
+}
+
+// currentVersion returns the current version of the document at path, 0 if
+// it does not exist yet. Unversioned documents count as version 1.
+func currentVersion(ctx context.Context, s logical.Storage, path string) (int, error) {
+	meta, err := getDocumentMetadata(ctx, s, path)
+	if err != nil {
+		return 0, err
+	}
+	if meta != nil {
+		return meta.CurrentVersion, nil
+	}
+
+	entry, err := s.Get(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	if entry == nil {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+func putDocumentMetadata(ctx context.Context, s logical.Storage, path string, meta *documentMetadata) error {
+	entry, err := logical.StorageEntryJSON(metadataKey(path), meta)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// loadDocumentMetadata returns the metadata for path, creating it if needed.
+// Documents written before versioning existed are imported as version 1 so
+// that their content is kept in the history on the next write.
+func (b *backend) loadDocumentMetadata(ctx context.Context, s logical.Storage, path string) (*documentMetadata, error) {
+	meta, err := getDocumentMetadata(ctx, s, path)
+	if err != nil || meta != nil {
+		return meta, err
+	}
+
+	meta = &documentMetadata{
+		Labels:   map[string]string{},
+		Versions: map[int]*versionMetadata{},
+	}
+
+	encEntry, err := s.Get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if encEntry == nil {
+		return meta, nil
+	}
+
+	decEntry, err := s.Get(ctx, decryptedKey(path))
+	if err != nil {
+		return nil, err
+	}
+	var decData []byte
+	if decEntry != nil {
+		decData = decEntry.Value
+	}
+
+	b.Logger().Info("importing unversioned document as version 1", "path", path)
+	if err := putVersion(ctx, s, path, 1, encEntry.Value, decData); err != nil {
+		return nil, err
+	}
+
+	// The writer and time of unversioned documents are unknown, the import
+	// time is the best approximation available
+	publicKey, _ := documentPublicKey(encEntry.Value)
+	now := time.Now().UTC()
+	meta.CurrentVersion = 1
+	meta.OldestVersion = 1
+	meta.CreatedTime = now
+	meta.UpdatedTime = now
+	meta.PublicKey = publicKey
+	meta.Versions[1] = &versionMetadata{
+		CreatedTime: now,
+		PublicKey:   publicKey,
+	}
+
+	return meta, nil
+}
+
+// putVersion stores the entries of a single version, decData is left out of
+// storage when nil.
+func putVersion(ctx context.Context, s logical.Storage, path string, version int, encData []byte, decData []byte) error {
+	if err := s.Put(ctx, &logical.StorageEntry{
+		Key:   versionKey(path, version),
+		Value: encData,
+	}); err != nil {
+		return err
+	}
+	if decData == nil {
+		return nil
+	}
+	return s.Put(ctx, &logical.StorageEntry{
+		Key:   decryptedKey(versionKey(path, version)),
+		Value: decData,
+	})
+}
+
+func deleteVersion(ctx context.Context, s logical.Storage, path string, version int) error {
+	if err := s.Delete(ctx, versionKey(path, version)); err != nil {
+		return err
+	}
+	return s.Delete(ctx, decryptedKey(versionKey(path, version)))
+}
+
+// storeDocument writes encData and its sanitized plaintext as a new version of
+// the document at path and makes it the current version. Versions beyond the
+// mount's max_versions are pruned, oldest first. With lazy decryption the
+// plaintext is not stored. The caller of req is recorded as the writer, and
+// rotatedFrom as the key of the previous version when the write rotates it.
+func (b *backend) storeDocument(ctx context.Context, req *logical.Request, path string, encData []byte, sanData []byte, rotatedFrom string) (*documentMetadata, error) {
+	s := req.Storage
+	config, err := b.config(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if config.lazyDecryption() {
+		sanData = nil
+	}
+
+	meta, err := b.loadDocumentMetadata(ctx, s, path)
+	if err != nil {
+		return nil, err
+	}
+	previousKeys := keyVersions(meta)
+
+	publicKey, err := documentPublicKey(encData)
+	if err != nil {
+		return nil, err
+	}
+
+	version := meta.CurrentVersion + 1
+	now := time.Now().UTC()
+	writer := writerFromRequest(req)
+
+	walID, err := framework.PutWAL(ctx, s, walKindStoreDocument, &documentWAL{
+		Path:    path,
+		Version: version,
+	})
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to write WAL entry: {{err}}", err)
+	}
+
+	b.Logger().Info("storing version of document", "path", path, "version", version)
+	if err := putVersion(ctx, s, path, version, encData, sanData); err != nil {
+		return nil, err
+	}
+
+	meta.CurrentVersion = version
+	if meta.OldestVersion == 0 {
+		meta.OldestVersion = version
+	}
+	if meta.CreatedTime.IsZero() {
+		meta.CreatedTime = now
+		meta.CreatedBy = writer
+	}
+	meta.UpdatedTime = now
+	meta.UpdatedBy = writer
+	meta.DeletedTime = time.Time{}
+	meta.DeletedBy = nil
+	meta.PublicKey = publicKey
+	meta.Versions[version] = &versionMetadata{
+		CreatedTime: now,
+		CreatedBy:   writer,
+		PublicKey:   publicKey,
+		RotatedFrom: rotatedFrom,
+	}
+
+	for meta.CurrentVersion-meta.OldestVersion >= config.maxVersions() {
+		b.Logger().Info("pruning version of document", "path", path, "version", meta.OldestVersion)
+		if err := deleteVersion(ctx, s, path, meta.OldestVersion); err != nil {
+			return nil, err
+		}
+		b.decryptedCache.Remove(versionKey(path, meta.OldestVersion))
+		delete(meta.Versions, meta.OldestVersion)
+		meta.OldestVersion++
+	}
+
+	currentKeys := keyVersions(meta)
+	if err := indexDocument(ctx, s, path, currentKeys); err != nil {
+		return nil, err
+	}
+	if err := putDocumentMetadata(ctx, s, path, meta); err != nil {
+		return nil, err
+	}
+	if err := unindexDocument(ctx, s, path, previousKeys, currentKeys); err != nil {
+		return nil, err
+	}
+
+	b.Logger().Info("storing encrypted value at", "path", path)
+	if err := s.Put(ctx, &logical.StorageEntry{
+		Key:   path,
+		Value: encData,
+	}); err != nil {
+		return nil, err
+	}
+	b.decryptedCache.Remove(path)
+
+	if sanData != nil {
+		b.Logger().Info("storing decrypted value at", "path", decryptedKey(path))
+		if err := s.Put(ctx, &logical.StorageEntry{
+			Key:   decryptedKey(path),
+			Value: sanData,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := framework.DeleteWAL(ctx, s, walID); err != nil {
+		return nil, errwrap.Wrapf("failed to remove WAL entry: {{err}}", err)
+	}
+
+	return meta, nil
+}
+
+// softDeleteDocument marks the document at path as deleted and removes its
+// current entries. Its versions and metadata are kept, so the document can be
+// restored with undeleteDocument until it is destroyed.
+func (b *backend) softDeleteDocument(ctx context.Context, req *logical.Request, path string) error {
+	s := req.Storage
+	meta, err := b.loadDocumentMetadata(ctx, s, path)
+	if err != nil {
+		return err
+	}
+	if meta.CurrentVersion == 0 || meta.deleted() {
+		return nil
+	}
+
+	walID, err := framework.PutWAL(ctx, s, walKindTombstoneDocument, &documentWAL{
+		Path:    path,
+		Version: meta.CurrentVersion,
+	})
+	if err != nil {
+		return errwrap.Wrapf("failed to write WAL entry: {{err}}", err)
+	}
+
+	// The metadata goes first as it is what marks the document as deleted
+	meta.DeletedTime = time.Now().UTC()
+	meta.DeletedBy = writerFromRequest(req)
+	if err := putDocumentMetadata(ctx, s, path, meta); err != nil {
+		return err
+	}
+
+	b.Logger().Info("deleting value at", "path", decryptedKey(path))
+	if err := s.Delete(ctx, decryptedKey(path)); err != nil {
+		return err
+	}
+	b.Logger().Info("deleting value at", "path", path)
+	if err := s.Delete(ctx, path); err != nil {
+		return err
+	}
+	b.decryptedCache.Remove(path)
+
+	if err := framework.DeleteWAL(ctx, s, walID); err != nil {
+		return errwrap.Wrapf("failed to remove WAL entry: {{err}}", err)
+	}
+	return nil
+}
+
+// undeleteDocument restores the current version of a soft deleted document.
+// It returns nil metadata when the document at path is not deleted.
+func (b *backend) undeleteDocument(ctx context.Context, s logical.Storage, path string) (*documentMetadata, error) {
+	config, err := b.config(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := getDocumentMetadata(ctx, s, path)
+	if err != nil || meta == nil || !meta.deleted() {
+		return nil, err
+	}
+
+	encEntry, err := s.Get(ctx, versionKey(path, meta.CurrentVersion))
+	if err != nil {
+		return nil, err
+	}
+	if encEntry == nil {
+		return nil, fmt.Errorf("failed to find version %d of %s", meta.CurrentVersion, path)
+	}
+	var decEntry *logical.StorageEntry
+	if !config.lazyDecryption() {
+		decEntry, err = s.Get(ctx, decryptedKey(versionKey(path, meta.CurrentVersion)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	walID, err := framework.PutWAL(ctx, s, walKindTombstoneDocument, &documentWAL{
+		Path:    path,
+		Version: meta.CurrentVersion,
+	})
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to write WAL entry: {{err}}", err)
+	}
+
+	meta.DeletedTime = time.Time{}
+	meta.DeletedBy = nil
+	if err := putDocumentMetadata(ctx, s, path, meta); err != nil {
+		return nil, err
+	}
+
+	b.Logger().Info("storing encrypted value at", "path", path)
+	if err := s.Put(ctx, &logical.StorageEntry{
+		Key:   path,
+		Value: encEntry.Value,
+	}); err != nil {
+		return nil, err
+	}
+	b.decryptedCache.Remove(path)
+
+	if decEntry != nil {
+		b.Logger().Info("storing decrypted value at", "path", decryptedKey(path))
+		if err := s.Put(ctx, &logical.StorageEntry{
+			Key:   decryptedKey(path),
+			Value: decEntry.Value,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := framework.DeleteWAL(ctx, s, walID); err != nil {
+		return nil, errwrap.Wrapf("failed to remove WAL entry: {{err}}", err)
+	}
+	return meta, nil
+}
+
+// purgeDeletedDocuments destroys every document that has been soft deleted
+// for longer than the deletion retention of the mount.
+func (b *backend) purgeDeletedDocuments(ctx context.Context, s logical.Storage) error {
+	config, err := b.config(ctx, s)
+	if err != nil {
+		return err
+	}
+	if config.DeletionRetention <= 0 {
+		return nil
+	}
+
+	paths, err := listDeletedDocuments(ctx, s, documentPrefix)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().UTC().Add(-config.DeletionRetention)
+	for _, path := range paths {
+		if err := b.purgeDeletedDocument(ctx, s, path, cutoff); err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("failed to purge %s: {{err}}", path), err)
+		}
+	}
+	return nil
+}
+
+func (b *backend) purgeDeletedDocument(ctx context.Context, s logical.Storage, path string, cutoff time.Time) error {
+	unlock := b.lockDocument(path)
+	defer unlock()
+
+	// The document may have been written or undeleted since it was listed
+	meta, err := getDocumentMetadata(ctx, s, path)
+	if err != nil || meta == nil || !meta.deleted() || meta.DeletedTime.After(cutoff) {
+		return err
+	}
+
+	b.Logger().Info("purging deleted document", "path", path, "deleted_time", meta.DeletedTime)
+	return b.deleteDocument(ctx, s, path)
+}
+
+// deleteDocument removes the current entries of the document at path along
+// with every stored version and its metadata.
+func (b *backend) deleteDocument(ctx context.Context, s logical.Storage, path string) error {
+	walID, err := framework.PutWAL(ctx, s, walKindDeleteDocument, &documentWAL{
+		Path: path,
+	})
+	if err != nil {
+		return errwrap.Wrapf("failed to write WAL entry: {{err}}", err)
+	}
+
+	if err := b.deleteDocumentEntries(ctx, s, path); err != nil {
+		return err
+	}
+
+	if err := framework.DeleteWAL(ctx, s, walID); err != nil {
+		return errwrap.Wrapf("failed to remove WAL entry: {{err}}", err)
+	}
+	return nil
+}
+
+func (b *backend) deleteDocumentEntries(ctx context.Context, s logical.Storage, path string) error {
+	// Remove the plaintext first so it never outlives its ciphertext
+	b.Logger().Info("deleting value at", "path", decryptedKey(path))
+	if err := s.Delete(ctx, decryptedKey(path)); err != nil {
+		return err
+	}
+
+	b.Logger().Info("deleting value at", "path", path)
+	if err := s.Delete(ctx, path); err != nil {
+		return err
+	}
+	b.decryptedCache.Remove(path)
+
+	// The metadata goes last as it is needed to find the versions to remove
+	meta, err := getDocumentMetadata(ctx, s, path)
+	if err != nil || meta == nil {
+		return err
+	}
+	for version := range meta.Versions {
+		if err := deleteVersion(ctx, s, path, version); err != nil {
+			return err
+		}
+		b.decryptedCache.Remove(versionKey(path, version))
+	}
+	if err := s.Delete(ctx, metadataKey(path)); err != nil {
+		return err
+	}
+	return unindexDocument(ctx, s, path, keyVersions(meta), nil)
+}
+
+// walRollback replays a WAL entry left behind by an interrupted write or
+// delete of a stored document.
+func (b *backend) walRollback(ctx context.Context, req *logical.Request, kind string, data interface{}) error {
+	var entry documentWAL
+	if err := mapstructure.Decode(data, &entry); err != nil {
+		return err
+	}
+
+	unlock := b.lockDocument(entry.Path)
+	defer unlock()
+
+	switch kind {
+	case walKindStoreDocument:
+		meta, err := getDocumentMetadata(ctx, req.Storage, entry.Path)
+		if err != nil {
+			return err
+		}
+		// The metadata is written once both entries of the new version are in
+		// place, without it the version never became current.
+		if meta == nil || meta.CurrentVersion < entry.Version {
+			b.Logger().Warn("rolling back partial write of document", "path", entry.Path, "version", entry.Version)
+			if err := deleteVersion(ctx, req.Storage, entry.Path, entry.Version); err != nil {
+				return err
+			}
+		}
+		_, err = b.repairDocument(ctx, req.Storage, entry.Path)
+		return err
+	case walKindDeleteDocument:
+		b.Logger().Warn("completing partial delete of document", "path", entry.Path)
+		return b.deleteDocumentEntries(ctx, req.Storage, entry.Path)
+	case walKindTombstoneDocument:
+		// The metadata is written first, so it decides whether the document
+		// ends up deleted or restored.
+		_, err := b.repairDocument(ctx, req.Storage, entry.Path)
+		return err
+	default:
+		return fmt.Errorf("unknown WAL entry type %q", kind)
+	}
+}
+
+// initialize replays every WAL entry left behind when the backend was last
+// stopped, so documents are consistent before serving requests, and moves
+// documents of older mounts into their namespace.
+func (b *backend) initialize(ctx context.Context, req *logical.InitializationRequest) error {
+	ids, err := framework.ListWAL(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		entry, err := framework.GetWAL(ctx, req.Storage, id)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			continue
+		}
+
+		if err := b.walRollback(ctx, &logical.Request{Storage: req.Storage}, entry.Kind, entry.Data); err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("failed to replay WAL entry %s: {{err}}", id), err)
+		}
+		if err := framework.DeleteWAL(ctx, req.Storage, id); err != nil {
+			return err
+		}
+	}
+
+	if err := b.migrateDocumentNamespace(ctx, req.Storage); err != nil {
+		return err
+	}
+
+	// Mounts written by versions without the index of documents per key
+	// would otherwise look unused to key deletion and rotation
+	added, removed, err := b.reindex(ctx, req.Storage)
+	if err != nil {
+		return errwrap.Wrapf("failed to rebuild the index of documents per key: {{err}}", err)
+	}
+	if added > 0 || removed > 0 {
+		b.Logger().Info("rebuilt the index of documents per key", "added", added, "removed", removed)
+	}
+	return nil
+}
+
+// repairDocument brings the current entries of the document at path in line
+// with each other. The current version recorded in the metadata is the source
+// of the ciphertext, the plaintext is always derived from the ciphertext.
+// It returns a description of what was inconsistent, or an empty string.
+func (b *backend) repairDocument(ctx context.Context, s logical.Storage, path string) (string, error) {
+	problem, encData, err := b.checkDocument(ctx, s, path)
+	if err != nil || problem == "" {
+		return problem, err
+	}
+
+	config, err := b.config(ctx, s)
+	if err != nil {
+		return problem, err
+	}
+	meta, err := getDocumentMetadata(ctx, s, path)
+	if err != nil {
+		return problem, err
+	}
+
+	b.Logger().Warn("repairing document", "path", path, "problem", problem)
+	if meta != nil && meta.deleted() {
+		if err := s.Delete(ctx, decryptedKey(path)); err != nil {
+			return problem, err
+		}
+		b.decryptedCache.Remove(path)
+		return problem, s.Delete(ctx, path)
+	}
+	if encData == nil || config.lazyDecryption() {
+		if err := s.Delete(ctx, decryptedKey(path)); err != nil {
+			return problem, err
+		}
+		if meta != nil {
+			if err := s.Delete(ctx, decryptedKey(versionKey(path, meta.CurrentVersion))); err != nil {
+				return problem, err
+			}
+		}
+	}
+	if encData == nil {
+		return problem, nil
+	}
+
+	if err := s.Put(ctx, &logical.StorageEntry{
+		Key:   path,
+		Value: encData,
+	}); err != nil {
+		return problem, err
+	}
+	b.decryptedCache.Remove(path)
+	if config.lazyDecryption() {
+		return problem, nil
+	}
+
+	sanData, err := b.sanitizedPlaintext(ctx, s, encData)
+	if err != nil {
+		return problem, err
+	}
+	if err := s.Put(ctx, &logical.StorageEntry{
+		Key:   decryptedKey(path),
+		Value: sanData,
+	}); err != nil {
+		return problem, err
+	}
+	if meta == nil {
+		return problem, nil
+	}
+	return problem, s.Put(ctx, &logical.StorageEntry{
+		Key:   decryptedKey(versionKey(path, meta.CurrentVersion)),
+		Value: sanData,
+	})
+}
+
+// checkDocument reports whether the current entries of the document at path
+// disagree, along with the ciphertext they should hold.
+func (b *backend) checkDocument(ctx context.Context, s logical.Storage, path string) (string, []byte, error) {
+	config, err := b.config(ctx, s)
+	if err != nil {
+		return "", nil, err
+	}
+
+	encEntry, err := s.Get(ctx, path)
+	if err != nil {
+		return "", nil, err
+	}
+	decEntry, err := s.Get(ctx, decryptedKey(path))
+	if err != nil {
+		return "", nil, err
+	}
+
+	var encData []byte
+	if encEntry != nil {
+		encData = encEntry.Value
+	}
+
+	meta, err := getDocumentMetadata(ctx, s, path)
+	if err != nil {
+		return "", nil, err
+	}
+	if meta != nil && meta.deleted() {
+		if encEntry != nil || decEntry != nil {
+			return "entries stored for deleted document", nil, nil
+		}
+		return "", nil, nil
+	}
+	if meta != nil {
+		versionEntry, err := s.Get(ctx, versionKey(path, meta.CurrentVersion))
+		if err != nil {
+			return "", nil, err
+		}
+		if versionEntry != nil && (encEntry == nil || !bytes.Equal(versionEntry.Value, encEntry.Value)) {
+			return "ciphertext does not match the current version", versionEntry.Value, nil
+		}
+	}
+
+	if encEntry == nil {
+		if decEntry != nil {
+			return "plaintext stored without ciphertext", nil, nil
+		}
+		return "", nil, nil
+	}
+	if config.lazyDecryption() {
+		if decEntry != nil {
+			return "plaintext stored with lazy decryption", encData, nil
+		}
+		return "", nil, nil
+	}
+	if decEntry == nil {
+		return "ciphertext stored without plaintext", encData, nil
+	}
+
+	sanData, err := b.sanitizedPlaintext(ctx, s, encData)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var want, got interface{}
+	if err := json.Unmarshal(sanData, &want); err != nil {
+		return "", nil, err
+	}
+	if err := json.Unmarshal(decEntry.Value, &got); err != nil {
+		return "plaintext is not valid json", encData, nil
+	}
+	if !reflect.DeepEqual(want, got) {
+		return "plaintext does not match ciphertext", encData, nil
+	}
+	return "", nil, nil
+}
+
+// readPlaintext returns the sanitized plaintext of the ciphertext stored at
+// encKey, or nil if there is none. With lazy decryption the ciphertext is
+// decrypted on demand and cached in memory.
+func (b *backend) readPlaintext(ctx context.Context, s logical.Storage, encKey string) ([]byte, error) {
+	config, err := b.config(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	if !config.lazyDecryption() {
+		entry, err := s.Get(ctx, decryptedKey(encKey))
+		if err != nil || entry == nil {
+			return nil, err
+		}
+		return entry.Value, nil
+	}
+
+	if cached, ok := b.decryptedCache.Get(encKey); ok {
+		return cached.([]byte), nil
+	}
+
+	entry, err := s.Get(ctx, encKey)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	b.Logger().Info("decrypting value at", "path", encKey)
+	sanData, err := b.sanitizedPlaintext(ctx, s, entry.Value)
+	if err != nil {
+		return nil, err
+	}
+	b.decryptedCache.Add(encKey, sanData)
+	return sanData, nil
+}
+
+// migrateDecryptionMode brings every stored document in line with the
+// decryption mode of config. Switching to lazy decryption deletes all stored
+// plaintext, switching back decrypts every version into storage again.
+func (b *backend) migrateDecryptionMode(ctx context.Context, s logical.Storage, config *ejsonConfig) error {
+	paths, err := listDocuments(ctx, s, documentPrefix)
+	if err != nil {
+		return err
+	}
+	// Deleted documents keep the plaintext of their versions until destroyed
+	deleted, err := listDeletedDocuments(ctx, s, documentPrefix)
+	if err != nil {
+		return err
+	}
+	paths = append(paths, deleted...)
+
+	b.Logger().Info("migrating stored documents", "decryption_mode", config.decryptionMode(), "documents", len(paths))
+	for _, path := range paths {
+		if err := b.migrateDocumentDecryption(ctx, s, path, config); err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("failed to migrate %s: {{err}}", path), err)
+		}
+	}
+	return nil
+}
+
+func (b *backend) migrateDocumentDecryption(ctx context.Context, s logical.Storage, path string, config *ejsonConfig) error {
+	unlock := b.lockDocument(path)
+	defer unlock()
+
+	meta, err := getDocumentMetadata(ctx, s, path)
+	if err != nil {
+		return err
+	}
+
+	encKeys := []string{path}
+	if meta != nil {
+		for version := range meta.Versions {
+			encKeys = append(encKeys, versionKey(path, version))
+		}
+	}
+
+	for _, encKey := range encKeys {
+		if config.lazyDecryption() {
+			if err := s.Delete(ctx, decryptedKey(encKey)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		entry, err := s.Get(ctx, encKey)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			continue
+		}
+		sanData, err := b.sanitizedPlaintext(ctx, s, entry.Value)
+		if err != nil {
+			b.Logger().Warn("failed to decrypt version of document", "path", encKey, "error", err)
+			continue
+		}
+		if err := s.Put(ctx, &logical.StorageEntry{
+			Key:   decryptedKey(encKey),
+			Value: sanData,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listDocuments walks storage below prefix and returns the path of every
+// stored document, skipping the entries that belong to a document such as its
+// plaintext, metadata and versions.
+func listDocuments(ctx context.Context, s logical.Storage, prefix string) ([]string, error) {
+	keys, err := s.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, k := range keys {
+		key := prefix + k
+		if isDocumentEntryKey(key) {
+			continue
+		}
+		if strings.HasSuffix(k, "/") {
+			children, err := listDocuments(ctx, s, key)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, children...)
+			continue
+		}
+		paths = append(paths, key)
+	}
+	return paths, nil
+}
+
+// listDeletedDocuments walks storage below prefix and returns the path of
+// every soft deleted document.
+func listDeletedDocuments(ctx context.Context, s logical.Storage, prefix string) ([]string, error) {
+	keys, err := s.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, k := range keys {
+		key := prefix + k
+		switch {
+		case k == "metadata" && prefix != documentPrefix:
+			path := strings.TrimSuffix(prefix, "/")
+			meta, err := getDocumentMetadata(ctx, s, path)
+			if err != nil {
+				return nil, err
+			}
+			if meta != nil && meta.deleted() {
+				paths = append(paths, path)
+			}
+		case strings.HasSuffix(k, "/") && !isDocumentEntryKey(key):
+			children, err := listDeletedDocuments(ctx, s, key)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, children...)
+		}
+	}
+	return paths, nil
+}
+
+// isDocumentEntryKey reports whether a storage key holds an entry belonging to
+// a document, such as its plaintext, rather than a document itself.
+func isDocumentEntryKey(key string) bool {
+	switch {
+	case strings.HasSuffix(key, "/decrypted"),
+		strings.HasSuffix(key, "/metadata"),
+		strings.HasSuffix(key, "/versions/"):
+		return true
+	}
+	return false
+}
+
+// namespaceMigration records the progress of moving the documents of a mount
+// below documentPrefix.
+type namespaceMigration struct {
+	// LegacyDocuments are the entries older versions stored below
+	// documentPrefix for documents named docs/<name>. They are recorded before
+	// anything is moved, as afterwards they cannot be told apart from the
+	// documents moved into the namespace.
+	LegacyDocuments []string `json:"legacy_documents"`
+	Done            bool     `json:"done"`
+}
+
+// getNamespaceMigration returns the progress of the namespace migration, or nil
+// if it has not started. A document of an older version stored at
+// namespaceMigrationKey is not mistaken for it.
+func getNamespaceMigration(ctx context.Context, s logical.Storage) (*namespaceMigration, bool, error) {
+	entry, err := s.Get(ctx, namespaceMigrationKey)
+	if err != nil || entry == nil {
+		return nil, false, err
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(entry.Value, &fields); err != nil {
+		return nil, true, nil
+	}
+	if _, ok := fields["done"]; !ok {
+		return nil, true, nil
+	}
+
+	migration := &namespaceMigration{}
+	if err := entry.DecodeJSON(migration); err != nil {
+		return nil, false, err
+	}
+	return migration, false, nil
+}
+
+func putNamespaceMigration(ctx context.Context, s logical.Storage, migration *namespaceMigration) error {
+	entry, err := logical.StorageEntryJSON(namespaceMigrationKey, migration)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// migrateDocumentNamespace moves documents stored at the root of the mount,
+// from before documents had their own namespace, below documentPrefix. It runs
+// once per mount: older versions stored nothing but documents and keys, so
+// entries such as config or index/ are documents until the migration is done,
+// and entries of this version afterwards.
+func (b *backend) migrateDocumentNamespace(ctx context.Context, s logical.Storage) error {
+	migration, legacy, err := getNamespaceMigration(ctx, s)
+	if err != nil {
+		return err
+	}
+	if migration != nil && migration.Done {
+		return nil
+	}
+
+	moved := 0
+	if migration == nil {
+		if legacy {
+			n, err := b.moveDocumentEntries(ctx, s, namespaceMigrationKey)
+			if err != nil {
+				return errwrap.Wrapf(fmt.Sprintf("failed to move %s below %s: {{err}}", namespaceMigrationKey, documentPrefix), err)
+			}
+			moved += n
+		}
+
+		keys, err := logical.CollectKeys(ctx, logical.NewStorageView(s, documentPrefix))
+		if err != nil {
+			return err
+		}
+		for i := range keys {
+			keys[i] = documentPrefix + keys[i]
+		}
+		// The document <name> moves to where docs/<name> is stored, so the
+		// deepest entries go first
+		sort.Slice(keys, func(i, j int) bool {
+			return len(keys[i]) > len(keys[j])
+		})
+
+		migration = &namespaceMigration{LegacyDocuments: keys}
+		if err := putNamespaceMigration(ctx, s, migration); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range migration.LegacyDocuments {
+		n, err := b.moveDocumentEntries(ctx, s, key)
+		if err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("failed to move %s below %s: {{err}}", key, documentPrefix), err)
+		}
+		moved += n
+	}
+
+	keys, err := s.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		switch key {
+		case documentPrefix, "keys/", framework.WALPrefix, namespaceMigrationKey:
+			continue
+		}
+
+		n, err := b.moveDocumentEntries(ctx, s, key)
+		if err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("failed to move %s below %s: {{err}}", key, documentPrefix), err)
+		}
+		moved += n
+	}
+
+	if moved > 0 {
+		b.Logger().Info("moved document entries into their namespace", "prefix", documentPrefix, "entries", moved)
+		b.decryptedCache.Purge()
+	}
+
+	migration.Done = true
+	return putNamespaceMigration(ctx, s, migration)
+}
+
+func (b *backend) moveDocumentEntries(ctx context.Context, s logical.Storage, key string) (int, error) {
+	if strings.HasSuffix(key, "/") {
+		children, err := s.List(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		moved := 0
+		for _, child := range children {
+			n, err := b.moveDocumentEntries(ctx, s, key+child)
+			if err != nil {
+				return moved, err
+			}
+			moved += n
+		}
+		return moved, nil
+	}
+
+	entry, err := s.Get(ctx, key)
+	if err != nil || entry == nil {
+		return 0, err
+	}
+
+	existing, err := s.Get(ctx, documentKey(key))
+	if err != nil {
+		return 0, err
+	}
+	if existing != nil {
+		b.Logger().Warn("not moving entry as its new key is taken", "path", key, "key", documentKey(key))
+		return 0, nil
+	}
+
+	if err := s.Put(ctx, &logical.StorageEntry{
+		Key:   documentKey(key),
+		Value: entry.Value,
+	}); err != nil {
+		return 0, err
+	}
+	return 1, s.Delete(ctx, key)
+}
@@ -12,10 +12,11 @@ require (
 	github.com/hashicorp/go-hclog v0.10.1
 	github.com/hashicorp/go-immutable-radix v1.1.0 // indirect
 	github.com/hashicorp/go-version v1.2.0 // indirect
-	github.com/hashicorp/golang-lru v0.5.3 // indirect
+	github.com/hashicorp/golang-lru v0.5.3
 	github.com/hashicorp/vault/api v1.0.5-0.20191216174727-9d51b36f3ae4
 	github.com/hashicorp/vault/sdk v0.1.14-0.20191218020134-06959d23b502
 	github.com/mattn/go-isatty v0.0.11 // indirect
+	github.com/mitchellh/mapstructure v1.1.2
 	github.com/pierrec/lz4 v2.4.0+incompatible // indirect
 	golang.org/x/crypto v0.0.0-20210506145944-38f3c27a63bf
 	google.golang.org/genproto v0.0.0-20190801165951-fa694d86fc64 // indirect
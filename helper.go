@@ -3,11 +3,15 @@ package secretsejson
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/Shopify/ejson"
+	"github.com/Shopify/ejson/crypto"
 	ej "github.com/Shopify/ejson/json"
+	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/sdk/logical"
 	"golang.org/x/crypto/scrypt"
 )
@@ -55,6 +59,43 @@ func EncryptEjson(ctx context.Context, decData []byte) ([]byte, error) {
 	return out.Bytes(), nil
 }
 
+// EncryptEjsonValues encrypts every plaintext for the hex encoded publicKey and
+// returns the boxed values in the format ejson stores them in a document.
+func EncryptEjsonValues(ctx context.Context, publicKey string, plaintexts []string) ([]string, error) {
+	pubKey, err := ParseKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like ejson itself, use one ephemeral key pair for all values
+	var kp crypto.Keypair
+	if err := kp.Generate(); err != nil {
+		return nil, fmt.Errorf("failed to generate keypair: %s", err)
+	}
+	encrypter := kp.Encrypter(pubKey)
+
+	boxed := make([]string, 0, len(plaintexts))
+	for _, plaintext := range plaintexts {
+		value, err := encrypter.Encrypt([]byte(plaintext))
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt value: %s", err)
+		}
+		boxed = append(boxed, string(value))
+	}
+	return boxed, nil
+}
+
+// ParseKey decodes a hex encoded ejson public or private key.
+func ParseKey(encoded string) ([32]byte, error) {
+	var key [32]byte
+	raw, err := hex.DecodeString(encoded)
+	if err != nil || len(raw) != len(key) {
+		return key, fmt.Errorf("invalid key %q", encoded)
+	}
+	copy(key[:], raw)
+	return key, nil
+}
+
 func DecryptEjson(ctx context.Context, encData []byte, storage logical.Storage) ([]byte, error) {
 	var out bytes.Buffer
 	var err error
@@ -65,17 +106,21 @@ func DecryptEjson(ctx context.Context, encData []byte, storage logical.Storage)
 	}
 
 	// Find the matching public key in keys/
-	keyPair, err := storage.Get(ctx, fmt.Sprintf("keys/%x", pubKey))
+	keyPair, err := getKey(ctx, storage, fmt.Sprintf("%x", pubKey))
 	if err != nil {
 		return nil, fmt.Errorf("failed to find public key in keys/: %s", err)
 	}
 	if keyPair == nil {
 		return nil, fmt.Errorf("failed to find key in keys/%x", pubKey)
 	}
+	if !keyPair.canDecrypt() {
+		return nil, fmt.Errorf("key keys/%x is %s", pubKey, keyPair.state())
+	}
 
-	if err := ejson.Decrypt(bytes.NewBuffer(encData), &out, "", string(keyPair.Value)); err != nil {
+	if err := ejson.Decrypt(bytes.NewBuffer(encData), &out, "", keyPair.Private); err != nil {
 		return nil, fmt.Errorf("failed to decrypt ejson: %s", err)
 	}
+
 	return out.Bytes(), nil
 }
 
@@ -104,13 +149,60 @@ func MarshalForEjson(input map[string]interface{}) ([]byte, error) {
 	return bytes, nil
 }
 
+// StripUnderscores returns data with the leading underscore ejson uses to
+// leave values unencrypted removed from its keys. Nested objects, including
+// those inside arrays, are only changed when recursive is set. It fails
+// rather than overwrite a value when both _foo and foo are present.
+func StripUnderscores(data map[string]interface{}, recursive bool) (map[string]interface{}, error) {
+	return stripUnderscores(data, recursive, "")
+}
+
+func stripUnderscores(data map[string]interface{}, recursive bool, path string) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		if recursive {
+			stripped, err := stripUnderscoresValue(v, path+k+".")
+			if err != nil {
+				return nil, err
+			}
+			v = stripped
+		}
+
+		key := strings.TrimPrefix(k, "_")
+		if _, ok := data[key]; ok && key != k {
+			return nil, errwrap.Wrapf(fmt.Sprintf("both %q and %q are set: {{err}}", path+k, path+key), logical.ErrInvalidRequest)
+		}
+		out[key] = v
+	}
+	return out, nil
+}
+
+func stripUnderscoresValue(value interface{}, path string) (interface{}, error) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return stripUnderscores(value, true, path)
+	case []interface{}:
+		out := make([]interface{}, len(value))
+		for i, v := range value {
+			stripped, err := stripUnderscoresValue(v, fmt.Sprintf("%s%d.", path, i))
+			if err != nil {
+				return nil, err
+			}
+			out[i] = stripped
+		}
+		return out, nil
+	default:
+		return value, nil
+	}
+}
+
 func HashPlaintext(plaintext []byte, salt []byte) ([]byte, error) {
 	return scrypt.Key(plaintext, salt, 1<<14, 8, 1, 32)
 }
 
 func (b *backend) IdentitySaltOrDefault(ctx context.Context, req *logical.Request) []byte {
 	// IMPROVEMENT: find something that works idenpendent of keys/
-	secretSalt, err := req.Storage.Get(ctx, "keys/__secret_salt")
+	secretSalt, err := req.Storage.Get(ctx, "keys/"+secretSaltKey)
 	if err != nil || secretSalt == nil {
 		b.Logger().Warn("No `secret_salt` set for ejson plaintext identity, using known insecure default!")
 		return []byte("ejson")
@@ -0,0 +1,235 @@
+package secretsejson
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// indexPrefix holds the reverse index from public keys to the documents
+// encrypted with them, as index/<public key>/<escaped document name>.
+const indexPrefix = "index/"
+
+func indexKey(public string, path string) string {
+	return fmt.Sprintf("%s%s/%s", indexPrefix, public, url.PathEscape(documentName(path)))
+}
+
+// keyVersions returns the retained versions of a document per public key.
+func keyVersions(meta *documentMetadata) map[string][]int {
+	keys := map[string][]int{}
+	if meta == nil {
+		return keys
+	}
+	for version, v := range meta.Versions {
+		if v.PublicKey == "" {
+			continue
+		}
+		keys[v.PublicKey] = append(keys[v.PublicKey], version)
+	}
+	for _, versions := range keys {
+		sort.Ints(versions)
+	}
+	return keys
+}
+
+// documentKeyVersions returns the retained versions of the document at path
+// per public key. Documents written before versioning count as version 1.
+func documentKeyVersions(ctx context.Context, s logical.Storage, path string) (map[string][]int, error) {
+	meta, err := getDocumentMetadata(ctx, s, path)
+	if err != nil {
+		return nil, err
+	}
+	if meta != nil {
+		return keyVersions(meta), nil
+	}
+
+	entry, err := s.Get(ctx, path)
+	if err != nil || entry == nil {
+		return map[string][]int{}, err
+	}
+	public, err := documentPublicKey(entry.Value)
+	if err != nil {
+		return map[string][]int{}, nil
+	}
+	return map[string][]int{public: {1}}, nil
+}
+
+// indexDocument adds the document at path to the index of every key in keys.
+// Entries are added before the metadata referencing the keys is stored, so the
+// index may hold stale entries but never misses a document.
+func indexDocument(ctx context.Context, s logical.Storage, path string, keys map[string][]int) error {
+	for public := range keys {
+		if err := s.Put(ctx, &logical.StorageEntry{
+			Key: indexKey(public, path),
+		}); err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("failed to index %s: {{err}}", path), err)
+		}
+	}
+	return nil
+}
+
+// unindexDocument removes the document at path from the index of every key in
+// previous that is not in current.
+func unindexDocument(ctx context.Context, s logical.Storage, path string, previous map[string][]int, current map[string][]int) error {
+	for public := range previous {
+		if _, ok := current[public]; ok {
+			continue
+		}
+		if err := s.Delete(ctx, indexKey(public, path)); err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("failed to unindex %s: {{err}}", path), err)
+		}
+	}
+	return nil
+}
+
+// reindex rebuilds the index from the metadata of every stored document. It
+// returns the number of entries added and removed.
+func (b *backend) reindex(ctx context.Context, s logical.Storage) (int, int, error) {
+	paths, err := listDocuments(ctx, s, documentPrefix)
+	if err != nil {
+		return 0, 0, err
+	}
+	deleted, err := listDeletedDocuments(ctx, s, documentPrefix)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	added := 0
+	for _, path := range append(paths, deleted...) {
+		n, err := b.reindexDocument(ctx, s, path)
+		if err != nil {
+			return added, 0, err
+		}
+		added += n
+	}
+
+	publics, err := s.List(ctx, indexPrefix)
+	if err != nil {
+		return added, 0, err
+	}
+	removed := 0
+	for _, public := range publics {
+		public = strings.TrimSuffix(public, "/")
+		names, err := s.List(ctx, indexPrefix+public+"/")
+		if err != nil {
+			return added, removed, err
+		}
+		for _, name := range names {
+			n, err := b.pruneIndexEntry(ctx, s, public, name)
+			if err != nil {
+				return added, removed, err
+			}
+			removed += n
+		}
+	}
+
+	return added, removed, nil
+}
+
+func (b *backend) reindexDocument(ctx context.Context, s logical.Storage, path string) (int, error) {
+	unlock := b.lockDocument(path)
+	defer unlock()
+
+	keys, err := documentKeyVersions(ctx, s, path)
+	if err != nil {
+		return 0, err
+	}
+
+	added := 0
+	for public := range keys {
+		entry, err := s.Get(ctx, indexKey(public, path))
+		if err != nil {
+			return added, err
+		}
+		if entry != nil {
+			continue
+		}
+		b.Logger().Info("indexing document", "path", path, "public_key", public)
+		if err := indexDocument(ctx, s, path, map[string][]int{public: nil}); err != nil {
+			return added, err
+		}
+		added++
+	}
+	return added, nil
+}
+
+// pruneIndexEntry removes the index entry of public for an escaped document
+// name if the document no longer uses the key.
+func (b *backend) pruneIndexEntry(ctx context.Context, s logical.Storage, public string, escaped string) (int, error) {
+	name, err := url.PathUnescape(escaped)
+	if err != nil {
+		b.Logger().Warn("removing malformed index entry", "public_key", public, "name", escaped)
+		return 1, s.Delete(ctx, indexPrefix+public+"/"+escaped)
+	}
+	path := documentKey(name)
+
+	unlock := b.lockDocument(path)
+	defer unlock()
+
+	keys, err := documentKeyVersions(ctx, s, path)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := keys[public]; ok {
+		return 0, nil
+	}
+
+	b.Logger().Info("removing stale index entry", "path", path, "public_key", public)
+	return 1, s.Delete(ctx, indexKey(public, path))
+}
+
+// keyUsageDocuments returns the documents using public, with their versions encrypted
+// with it. Stale index entries are skipped.
+func (b *backend) keyUsageDocuments(ctx context.Context, s logical.Storage, public string) (map[string]interface{}, error) {
+	names, err := s.List(ctx, indexPrefix+public+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	documents := map[string]interface{}{}
+	for _, escaped := range names {
+		name, err := url.PathUnescape(escaped)
+		if err != nil {
+			continue
+		}
+		path := documentKey(name)
+
+		meta, err := getDocumentMetadata(ctx, s, path)
+		if err != nil {
+			return nil, err
+		}
+		if meta == nil {
+			// Documents written before versioning only have a current version
+			keys, err := documentKeyVersions(ctx, s, path)
+			if err != nil {
+				return nil, err
+			}
+			if versions, ok := keys[public]; ok {
+				documents[name] = map[string]interface{}{
+					"versions": versions,
+					"current":  true,
+					"deleted":  false,
+				}
+			}
+			continue
+		}
+
+		versions, ok := keyVersions(meta)[public]
+		if !ok {
+			continue
+		}
+		current := meta.Versions[meta.CurrentVersion] != nil && meta.Versions[meta.CurrentVersion].PublicKey == public
+		deleted := meta.deleted()
+		documents[name] = map[string]interface{}{
+			"versions": versions,
+			"current":  current,
+			"deleted":  deleted,
+		}
+	}
+	return documents, nil
+}
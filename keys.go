@@ -0,0 +1,229 @@
+package secretsejson
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/ejson"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// keyStateActive keys encrypt and decrypt.
+	keyStateActive = "active"
+	// keyStateDecryptOnly keys are deprecated, they still decrypt but nothing
+	// new is encrypted with them.
+	keyStateDecryptOnly = "decrypt-only"
+	// keyStateArchived keys are retained but not used at all.
+	keyStateArchived = "archived"
+)
+
+// keyEntry is the key pair stored at keys/<public key>, along with what is
+// known about its owner and use.
+type keyEntry struct {
+	Private string `json:"private"`
+	// Exportable allows the private key to be read back through keys/
+	Exportable bool `json:"exportable"`
+
+	Name         string    `json:"name"`
+	Description  string    `json:"description"`
+	Owner        string    `json:"owner"`
+	CreatedTime  time.Time `json:"created_time"`
+	LastUsedTime time.Time `json:"last_used_time"`
+	DecryptCount int64     `json:"decrypt_count"`
+
+	// DeletionAllowed protects the key pair from deletion when false, unset
+	// for key pairs that never changed it
+	DeletionAllowed *bool `json:"deletion_allowed,omitempty"`
+
+	// State is one of the keyState constants, empty for active key pairs
+	State string `json:"state,omitempty"`
+
+	// legacy marks entries that only hold the private key
+	legacy bool
+}
+
+// deletionAllowed reports whether the key pair may be deleted.
+func (k *keyEntry) deletionAllowed() bool {
+	return k.DeletionAllowed == nil || *k.DeletionAllowed
+}
+
+func (k *keyEntry) state() string {
+	if k.State == "" {
+		return keyStateActive
+	}
+	return k.State
+}
+
+// canEncrypt reports whether new values may be encrypted with the key pair.
+func (k *keyEntry) canEncrypt() bool {
+	return k.state() == keyStateActive
+}
+
+// canDecrypt reports whether the private key may be used to decrypt.
+func (k *keyEntry) canDecrypt() bool {
+	return k.state() != keyStateArchived
+}
+
+// keyUsage counts the decryptions with a key that are not in storage yet.
+type keyUsage struct {
+	DecryptCount int64
+	LastUsedTime time.Time
+}
+
+func keyPath(public string) string {
+	return fmt.Sprintf("keys/%s", public)
+}
+
+// getKey returns the key pair stored for the hex encoded public key, or nil if
+// there is none. Entries from before keys had settings only hold the private
+// key and remain exportable.
+func getKey(ctx context.Context, s logical.Storage, public string) (*keyEntry, error) {
+	entry, err := s.Get(ctx, keyPath(public))
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(entry.Value, []byte("{")) {
+		return &keyEntry{
+			Private:    string(entry.Value),
+			Exportable: true,
+			legacy:     true,
+		}, nil
+	}
+
+	key := &keyEntry{}
+	if err := entry.DecodeJSON(key); err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("failed to decode key %s: {{err}}", public), err)
+	}
+	return key, nil
+}
+
+func putKey(ctx context.Context, s logical.Storage, public string, key *keyEntry) error {
+	entry, err := logical.StorageEntryJSON(keyPath(public), key)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// generateKeyPair stores a new key pair with the settings of key and returns
+// its public key.
+func (b *backend) generateKeyPair(ctx context.Context, s logical.Storage, key *keyEntry) (string, error) {
+	public, private, err := ejson.GenerateKeypair()
+	if err != nil {
+		return "", errwrap.Wrapf("failed to generate keypair ejson: {{err}}", err)
+	}
+	key.Private = private
+	key.CreatedTime = time.Now().UTC()
+
+	b.Logger().Info(fmt.Sprintf("New key pair at %s", keyPath(public)))
+	if err := putKey(ctx, s, public, key); err != nil {
+		return "", err
+	}
+	return public, nil
+}
+
+// recordKeyUse counts a decryption with the key of public. Counts are kept in
+// memory and written to storage by flushKeyUsage, so decrypting never writes.
+func (b *backend) recordKeyUse(public string) {
+	b.keyUsageLock.Lock()
+	defer b.keyUsageLock.Unlock()
+
+	usage, ok := b.keyUsage[public]
+	if !ok {
+		usage = &keyUsage{}
+		b.keyUsage[public] = usage
+	}
+	usage.DecryptCount++
+	usage.LastUsedTime = time.Now().UTC()
+}
+
+// pendingKeyUse returns the decryptions with the key of public that are not
+// in storage yet.
+func (b *backend) pendingKeyUse(public string) keyUsage {
+	b.keyUsageLock.Lock()
+	defer b.keyUsageLock.Unlock()
+
+	if usage, ok := b.keyUsage[public]; ok {
+		return *usage
+	}
+	return keyUsage{}
+}
+
+// flushKeyUsage adds the decryptions counted since the last flush to the
+// stored key entries.
+func (b *backend) flushKeyUsage(ctx context.Context, s logical.Storage) error {
+	b.keyUsageLock.Lock()
+	pending := b.keyUsage
+	b.keyUsage = map[string]*keyUsage{}
+	b.keyUsageLock.Unlock()
+
+	for public, usage := range pending {
+		if err := b.flushUsageOfKey(ctx, s, public, usage); err != nil {
+			// Keep the counts for the next flush
+			b.keyUsageLock.Lock()
+			for public, usage := range pending {
+				current, ok := b.keyUsage[public]
+				if !ok {
+					b.keyUsage[public] = usage
+					continue
+				}
+				current.DecryptCount += usage.DecryptCount
+				if usage.LastUsedTime.After(current.LastUsedTime) {
+					current.LastUsedTime = usage.LastUsedTime
+				}
+			}
+			b.keyUsageLock.Unlock()
+			return errwrap.Wrapf(fmt.Sprintf("failed to store usage of key %s: {{err}}", public), err)
+		}
+		delete(pending, public)
+	}
+	return nil
+}
+
+func (b *backend) flushUsageOfKey(ctx context.Context, s logical.Storage, public string, usage *keyUsage) error {
+	unlock := b.lockDocument(keyPath(public))
+	defer unlock()
+
+	key, err := getKey(ctx, s, public)
+	if err != nil || key == nil {
+		return err
+	}
+	// Key pairs that only held their private key are stored as a structured
+	// entry from here on. Their creation time is unknown and left zero.
+	key.DecryptCount += usage.DecryptCount
+	if usage.LastUsedTime.After(key.LastUsedTime) {
+		key.LastUsedTime = usage.LastUsedTime
+	}
+	return putKey(ctx, s, public, key)
+}
+
+// decryptEjson decrypts encData like DecryptEjson and counts the use of the
+// key it was decrypted with.
+func (b *backend) decryptEjson(ctx context.Context, s logical.Storage, encData []byte) ([]byte, error) {
+	decData, err := DecryptEjson(ctx, encData, s)
+	if err != nil {
+		return nil, err
+	}
+	if public, err := documentPublicKey(encData); err == nil {
+		b.recordKeyUse(public)
+	}
+	return decData, nil
+}
+
+// decryptEjsonDocument decrypts encData like DecryptEjsonDocument and counts
+// the use of the key it was decrypted with.
+func (b *backend) decryptEjsonDocument(ctx context.Context, req *logical.Request, encData []byte) (map[string]interface{}, error) {
+	decData, err := DecryptEjsonDocument(ctx, req, encData)
+	if err != nil {
+		return nil, err
+	}
+	if public, err := documentPublicKey(encData); err == nil {
+		b.recordKeyUse(public)
+	}
+	return decData, nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/hashicorp/errwrap"
@@ -11,9 +12,67 @@ import (
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
+// documentReadFields are the parameters of document reads.
+var documentReadFields = map[string]*framework.FieldSchema{
+	"version": &framework.FieldSchema{
+		Type:        framework.TypeInt,
+		Description: "Version of the document to read, defaults to the current version",
+	},
+	"field": &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "JSON pointer to a single field to read from the decrypted document",
+	},
+}
+
+// documentWriteFields are the parameters of document writes, which are only
+// taken from writes wrapping the document in ejson. A raw write is stored as
+// is, whatever the names of its keys.
+var documentWriteFields = map[string]*framework.FieldSchema{
+	"ejson": &framework.FieldSchema{
+		Type:        framework.TypeMap,
+		Description: "EJSON document",
+	},
+	"cas": &framework.FieldSchema{
+		Type:        framework.TypeInt,
+		Description: "Version the write expects to replace, 0 only allows creating the document",
+	},
+}
+
+// documentListFields are the parameters of document lists.
+var documentListFields = map[string]*framework.FieldSchema{
+	"recursive": &framework.FieldSchema{
+		Type:        framework.TypeBool,
+		Description: "List every stored document below the path instead of a single level",
+	},
+	"prefix": &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Only list documents whose path below the listed path starts with this prefix",
+	},
+	"labels": &framework.FieldSchema{
+		Type:        framework.TypeKVPairs,
+		Description: "Only list documents carrying all of these labels",
+	},
+	"public_key": &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Only list documents encrypted with this public key",
+	},
+	"after": &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Only list documents sorting after this path, used for pagination",
+	},
+	"limit": &framework.FieldSchema{
+		Type:        framework.TypeInt,
+		Description: "Maximum number of documents to list, 0 lists all",
+	},
+}
+
 func ejsonPaths(b *backend) []*framework.Path {
 	return []*framework.Path{
 		&framework.Path{
+			// The document path is taken from the request path rather than a
+			// capture, as raw writes would otherwise store it in the document.
+			// For the same reason the parameters of each operation are parsed
+			// by its callback, see documentReadFields.
 			Pattern: ".*",
 			Fields: map[string]*framework.FieldSchema{
 				"ejson": &framework.FieldSchema{
@@ -21,7 +80,7 @@ func ejsonPaths(b *backend) []*framework.Path {
 					Description: "EJSON document",
 				},
 			},
-			ExistenceCheck: b.pathExistenceCheck,
+			ExistenceCheck: b.documentExistenceCheck,
 			Callbacks: map[logical.Operation]framework.OperationFunc{
 				logical.ReadOperation:   b.ejsonRead,
 				logical.CreateOperation: b.ejsonCreateUpdate,
@@ -33,26 +92,90 @@ func ejsonPaths(b *backend) []*framework.Path {
 	}
 }
 
-func (b *backend) ejsonRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	entry, err := req.Storage.Get(ctx, req.Path)
+// operationData parses the parameters of a request to the catch-all document
+// path against the schema of its operation.
+func operationData(data *framework.FieldData, schema map[string]*framework.FieldSchema) (*framework.FieldData, *logical.Response, error) {
+	opData := &framework.FieldData{
+		Raw:    data.Raw,
+		Schema: schema,
+	}
+	if err := opData.Validate(); err != nil {
+		return nil, logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+	return opData, nil, nil
+}
+
+func (b *backend) documentExistenceCheck(ctx context.Context, req *logical.Request, data *framework.FieldData) (bool, error) {
+	out, err := req.Storage.Get(ctx, documentKey(documentName(req.Path)))
 	if err != nil {
-		return nil, err
+		return false, errwrap.Wrapf("existence check failed: {{err}}", err)
+	}
+
+	return out != nil, nil
+}
+
+func (b *backend) ejsonRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	data, resp, err := operationData(data, documentReadFields)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	name, decrypted := splitDecryptedPath(documentName(req.Path))
+	if resp, err := b.checkDocumentPath(req, name); resp != nil || err != nil {
+		return resp, err
+	}
+	// Entries of a document such as <path>/versions/<n> are only read through
+	// the endpoints of the document, which honour its deletion
+	if err := validateDocumentName(name); err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+	path := documentKey(name)
+	if field, ok := data.GetOk("field"); ok {
+		if !decrypted {
+			return logical.ErrorResponse("field can only be read from the decrypted document"), logical.ErrInvalidRequest
+		}
+		return b.readDecryptedField(ctx, req, path, data.Get("version").(int), field.(string))
+	}
+
+	key := path
+	if version := data.Get("version").(int); version > 0 {
+		if resp, err := checkNotDeleted(ctx, req.Storage, path); resp != nil || err != nil {
+			return resp, err
+		}
+		key = versionKey(path, version)
+	}
+
+	var value []byte
+	if decrypted {
+		sanData, err := b.readPlaintext(ctx, req.Storage, key)
+		if err != nil {
+			return nil, err
+		}
+		value = sanData
+	} else {
+		entry, err := req.Storage.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			value = entry.Value
+		}
 	}
 
-	if entry == nil {
-		return logical.ErrorResponse(fmt.Sprintf("failed to find value at %s", req.Path)), nil
+	if value == nil {
+		return logical.ErrorResponse(fmt.Sprintf("failed to find value at %s", documentName(req.Path))), nil
 	}
 
-	b.Logger().Info("reading value at", "path", req.Path)
+	b.Logger().Info("reading value at", "path", key)
 	// Return the secret
-	resp := &logical.Response{
+	resp = &logical.Response{
 		Data: map[string]interface{}{
 			"ejson": nil,
 		},
 	}
 
 	vData := map[string]interface{}{}
-	if err := json.Unmarshal([]byte(entry.Value), &vData); err != nil {
+	if err := json.Unmarshal(value, &vData); err != nil {
 		return nil, err
 	}
 
@@ -62,73 +185,109 @@ func (b *backend) ejsonRead(ctx context.Context, req *logical.Request, data *fra
 }
 
 func (b *backend) ejsonCreateUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	inputData, ok := data.GetOk("ejson")
-	if !ok {
+	name := documentName(req.Path)
+	if resp, err := b.checkDocumentPath(req, name); resp != nil || err != nil {
+		return resp, err
+	}
+
+	if _, ok := data.GetOk("ejson"); !ok {
 		if len(data.Raw) == 0 {
 			return logical.ErrorResponse("no data provided"), logical.ErrInvalidRequest
 		}
-		inputData = data.Raw
+		// Every key of a raw write belongs to the document, so it carries no
+		// parameters
+		params := &framework.FieldData{Schema: documentWriteFields}
+		return b.putDocument(ctx, req, params, name, data.Raw)
 	}
 
-	encData, err := MarshalInput(inputData)
-	if err != nil {
-		return nil, errwrap.Wrapf("failed to marshall json: {{err}}", err)
+	data, resp, err := operationData(data, documentWriteFields)
+	if resp != nil || err != nil {
+		return resp, err
 	}
+	return b.putDocument(ctx, req, data, name, data.Get("ejson"))
+}
 
-	decData, err := DecryptEjsonDocument(ctx, req, encData)
-	if err != nil {
-		return nil, errwrap.Wrapf("failed to decrypt ejson: {{err}}", err)
+// putDocument stores inputData as the next version of the document name,
+// honouring the cas parameter in data.
+func (b *backend) putDocument(ctx context.Context, req *logical.Request, data *framework.FieldData, name string, inputData interface{}) (*logical.Response, error) {
+	if err := validateDocumentName(name); err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
 	}
-	// Remove the _public_key key so it doesn't end up as a value
-	delete(decData, "_public_key")
+	path := documentKey(name)
 
-	// Strip underscores from key values before storing it decrypted for ease-of-access
-	for k, v := range decData {
-		if strings.HasPrefix(k, "_") {
-			decData[strings.TrimPrefix(k, "_")] = v
-			delete(decData, k)
-		}
+	unlock := b.lockDocument(path)
+	defer unlock()
+
+	if resp, err := b.checkAndSet(ctx, req, data, path); resp != nil || err != nil {
+		return resp, err
 	}
 
-	// Marshal the sanitized values one last time so we can store it
-	sanData, err := json.Marshal(decData)
+	encData, err := MarshalInput(inputData)
 	if err != nil {
-		return nil, errwrap.Wrapf("failed to marshall sanitized json: {{err}}", err)
+		return nil, errwrap.Wrapf("failed to marshall json: {{err}}", err)
 	}
 
-	b.Logger().Info("storing encrypted value at", "path", req.Path)
-	encEntry := &logical.StorageEntry{
-		Key:   req.Path,
-		Value: encData,
-	}
-	if err := req.Storage.Put(ctx, encEntry); err != nil {
+	sanData, err := b.sanitizedPlaintext(ctx, req.Storage, encData)
+	if err != nil {
 		return nil, err
 	}
 
-	b.Logger().Info("storing decrypted value at", "path", fmt.Sprintf("%s/decrypted", req.Path))
-	decEntry := &logical.StorageEntry{
-		Key:   fmt.Sprintf("%s/decrypted", req.Path),
-		Value: sanData,
-	}
-	if err := req.Storage.Put(ctx, decEntry); err != nil {
+	meta, err := b.storeDocument(ctx, req, path, encData, sanData, "")
+	if err != nil {
 		return nil, err
 	}
 
 	return &logical.Response{
 		Data: map[string]interface{}{
-			"ejson": inputData,
+			"ejson":   inputData,
+			"version": meta.CurrentVersion,
 		},
 	}, nil
 }
 
-func (b *backend) ejsonDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	b.Logger().Info("deleting value at", "path", req.Path)
-	if err := req.Storage.Delete(ctx, req.Path); err != nil {
+// checkAndSet compares the cas parameter of a write with the current version
+// of the document, returning an error response when they do not match or when
+// the mount requires cas and none was given.
+func (b *backend) checkAndSet(ctx context.Context, req *logical.Request, data *framework.FieldData, path string) (*logical.Response, error) {
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	cas, ok := data.GetOk("cas")
+	if !ok {
+		if config.CASRequired {
+			return logical.ErrorResponse("check-and-set parameter required for this call"), logical.ErrInvalidRequest
+		}
+		return nil, nil
+	}
+
+	current, err := currentVersion(ctx, req.Storage, path)
+	if err != nil {
 		return nil, err
 	}
+	if cas.(int) != current {
+		return logical.ErrorResponse(fmt.Sprintf("check-and-set parameter did not match the current version %d of %s", current, documentName(path))), logical.ErrInvalidRequest
+	}
+	return nil, nil
+}
 
-	b.Logger().Info("deleting value at", "path", fmt.Sprintf("%s/decrypted", req.Path))
-	if err := req.Storage.Delete(ctx, fmt.Sprintf("%s/decrypted", req.Path)); err != nil {
+func (b *backend) ejsonDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	// Entries of a document such as <path>/decrypted are not documents of
+	// their own
+	name := documentName(req.Path)
+	if resp, err := b.checkDocumentPath(req, name); resp != nil || err != nil {
+		return resp, err
+	}
+	if err := validateDocumentName(name); err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+	path := documentKey(name)
+
+	unlock := b.lockDocument(path)
+	defer unlock()
+
+	if err := b.softDeleteDocument(ctx, req, path); err != nil {
 		return nil, err
 	}
 
@@ -136,9 +295,121 @@ func (b *backend) ejsonDelete(ctx context.Context, req *logical.Request, data *f
 }
 
 func (b *backend) ejsonList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	vals, err := req.Storage.List(ctx, req.Path)
+	if resp, err := b.checkDocumentPath(req, documentName(req.Path)); resp != nil || err != nil {
+		return resp, err
+	}
+
+	data, resp, err := operationData(data, documentListFields)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	if data.Get("recursive").(bool) {
+		return b.ejsonListRecursive(ctx, req, data)
+	}
+
+	vals, err := req.Storage.List(ctx, documentKey(documentName(req.Path)))
 	if err != nil {
 		return nil, err
 	}
 	return logical.ListResponse(vals), nil
 }
+
+// ejsonListRecursive lists the paths of all stored documents below the
+// requested path, relative to it and sorted, leaving out the entries that
+// belong to a document such as its decrypted copy.
+func (b *backend) ejsonListRecursive(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	prefix := data.Get("prefix").(string)
+	labels := data.Get("labels").(map[string]string)
+	publicKey := data.Get("public_key").(string)
+	after := data.Get("after").(string)
+	limit := data.Get("limit").(int)
+	if limit < 0 {
+		return logical.ErrorResponse("limit cannot be negative"), logical.ErrInvalidRequest
+	}
+
+	listPath := documentKey(documentName(req.Path))
+	paths, err := listDocuments(ctx, req.Storage, listPath)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	keys := []string{}
+	for _, path := range paths {
+		key := strings.TrimPrefix(path, listPath)
+		if !strings.HasPrefix(key, prefix) || (after != "" && key <= after) {
+			continue
+		}
+
+		if len(labels) > 0 || publicKey != "" {
+			match, err := documentMatches(ctx, req.Storage, path, labels, publicKey)
+			if err != nil {
+				return nil, err
+			}
+			if !match {
+				continue
+			}
+		}
+
+		keys = append(keys, key)
+		if limit > 0 && len(keys) == limit {
+			break
+		}
+	}
+
+	return logical.ListResponse(keys), nil
+}
+
+// documentMatches reports whether the document at path carries all labels and
+// is encrypted with publicKey, either of which may be empty.
+func documentMatches(ctx context.Context, s logical.Storage, path string, labels map[string]string, publicKey string) (bool, error) {
+	meta, err := getDocumentMetadata(ctx, s, path)
+	if err != nil {
+		return false, err
+	}
+	if meta == nil {
+		// Unversioned documents carry no labels and their public key only
+		// lives in the ciphertext
+		if len(labels) > 0 {
+			return false, nil
+		}
+		entry, err := s.Get(ctx, path)
+		if err != nil || entry == nil {
+			return false, err
+		}
+		entryKey, err := documentPublicKey(entry.Value)
+		if err != nil {
+			return false, nil
+		}
+		return entryKey == publicKey, nil
+	}
+
+	for k, v := range labels {
+		if meta.Labels[k] != v {
+			return false, nil
+		}
+	}
+	return publicKey == "" || meta.PublicKey == publicKey, nil
+}
+
+// checkRawParameters rejects parameters given alongside a document submitted as
+// the raw request body. They cannot be told apart from the fields of the
+// document, so requests with parameters must wrap the document in ejson.
+func checkRawParameters(raw map[string]interface{}, params ...string) (*logical.Response, error) {
+	for _, param := range params {
+		if _, ok := raw[param]; ok {
+			return logical.ErrorResponse(fmt.Sprintf("%s can only be given with the document wrapped in ejson", param)), logical.ErrInvalidRequest
+		}
+	}
+	return nil, nil
+}
+
+// splitDecryptedPath returns the document path a request path refers to and
+// whether it addressed the decrypted copy of that document.
+func splitDecryptedPath(path string) (string, bool) {
+	if strings.HasSuffix(path, "/decrypted") {
+		return strings.TrimSuffix(path, "/decrypted"), true
+	}
+	return path, false
+}
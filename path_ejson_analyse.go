@@ -100,7 +100,7 @@ func (b *backend) analyse(ctx context.Context, req *logical.Request, data *frame
 		return nil, errwrap.Wrapf("failed to marshall json: {{err}}", err)
 	}
 
-	decData, err := DecryptEjson(ctx, encData, req.Storage)
+	decData, err := b.decryptEjson(ctx, req.Storage, encData)
 	if err != nil {
 		return nil, errwrap.Wrapf("failed to decrypt ejson: {{err}}", err)
 	}
@@ -0,0 +1,292 @@
+package secretsejson
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/parseutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	configPath = "config"
+
+	defaultMaxVersions = 10
+
+	// decryptionModeStored keeps the decrypted copy of every document in
+	// storage next to its ciphertext.
+	decryptionModeStored = "stored"
+	// decryptionModeLazy only stores ciphertext and decrypts documents when
+	// their decrypted path is read.
+	decryptionModeLazy = "lazy"
+
+	// underscorePolicyTopLevel strips the leading underscore from top-level
+	// keys of decrypted documents only.
+	underscorePolicyTopLevel = "top_level"
+	// underscorePolicyAll strips the leading underscore from keys at every
+	// depth of decrypted documents.
+	underscorePolicyAll = "all"
+	// underscorePolicyNone keeps keys of decrypted documents as they are.
+	underscorePolicyNone = "none"
+)
+
+// ejsonConfig holds the mount-wide settings of the backend.
+type ejsonConfig struct {
+	MaxVersions      int    `json:"max_versions"`
+	CASRequired      bool   `json:"cas_required"`
+	DecryptionMode   string `json:"decryption_mode"`
+	UnderscorePolicy string `json:"underscore_policy"`
+
+	// DeletionRetention is how long soft deleted documents are kept before
+	// they are destroyed, 0 keeps them until destroyed explicitly.
+	DeletionRetention time.Duration `json:"deletion_retention"`
+
+	// RotationPeriod is the age of a key after which the stored documents
+	// encrypted with it are rotated to a new key, 0 disables scheduled
+	// rotation.
+	RotationPeriod time.Duration `json:"rotation_period"`
+	// RotationPolicies override the rotation period for documents below a
+	// prefix, the longest matching prefix applies.
+	RotationPolicies map[string]time.Duration `json:"rotation_policies"`
+}
+
+// rotationPeriod returns the rotation period of the document name.
+func (c *ejsonConfig) rotationPeriod(name string) time.Duration {
+	period, matched := c.RotationPeriod, ""
+	for prefix, p := range c.RotationPolicies {
+		if strings.HasPrefix(name, prefix) && len(prefix) > len(matched) {
+			period, matched = p, prefix
+		}
+	}
+	return period
+}
+
+// minRotationPeriod returns the shortest rotation period of any document, 0
+// if rotation is not scheduled.
+func (c *ejsonConfig) minRotationPeriod() time.Duration {
+	min := c.RotationPeriod
+	for _, p := range c.RotationPolicies {
+		if p > 0 && (min == 0 || p < min) {
+			min = p
+		}
+	}
+	return min
+}
+
+func (c *ejsonConfig) underscorePolicy() string {
+	if c.UnderscorePolicy == "" {
+		return underscorePolicyTopLevel
+	}
+	return c.UnderscorePolicy
+}
+
+func (c *ejsonConfig) lazyDecryption() bool {
+	return c.DecryptionMode == decryptionModeLazy
+}
+
+func (c *ejsonConfig) decryptionMode() string {
+	if c.DecryptionMode == "" {
+		return decryptionModeStored
+	}
+	return c.DecryptionMode
+}
+
+func (c *ejsonConfig) maxVersions() int {
+	if c.MaxVersions <= 0 {
+		return defaultMaxVersions
+	}
+	return c.MaxVersions
+}
+
+func ejsonConfigPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: configPath,
+			Fields: map[string]*framework.FieldSchema{
+				"max_versions": {
+					Type:        framework.TypeInt,
+					Description: "Number of versions kept per stored document, 0 means the default of 10",
+				},
+				"cas_required": {
+					Type:        framework.TypeBool,
+					Description: "Require the cas parameter on every write of a stored document",
+				},
+				"decryption_mode": {
+					Type:          framework.TypeString,
+					Description:   "Either stored, to keep decrypted documents in storage, or lazy, to decrypt them on read",
+					AllowedValues: []interface{}{decryptionModeStored, decryptionModeLazy},
+				},
+				"underscore_policy": {
+					Type:          framework.TypeString,
+					Description:   "Which leading underscores are stripped from keys of decrypted documents, one of top_level, all or none",
+					AllowedValues: []interface{}{underscorePolicyTopLevel, underscorePolicyAll, underscorePolicyNone},
+				},
+				"deletion_retention": {
+					Type:        framework.TypeDurationSecond,
+					Description: "How long deleted documents are kept before they are destroyed, 0 keeps them until destroyed explicitly",
+				},
+				"rotation_period": {
+					Type:        framework.TypeString,
+					Description: "Age of a key after which the stored documents encrypted with it are rotated to a new key, such as 90d. 0 disables scheduled rotation",
+				},
+				"rotation_policies": {
+					Type:        framework.TypeKVPairs,
+					Description: "Rotation periods of the documents below a prefix, overriding rotation_period. The longest matching prefix applies",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.configRead,
+				logical.CreateOperation: b.configWrite,
+				logical.UpdateOperation: b.configWrite,
+			},
+		},
+	}
+}
+
+func (b *backend) config(ctx context.Context, s logical.Storage) (*ejsonConfig, error) {
+	entry, err := s.Get(ctx, configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ejsonConfig{}
+	if entry == nil {
+		return config, nil
+	}
+
+	if err := entry.DecodeJSON(config); err != nil {
+		return nil, errwrap.Wrapf("failed to decode config: {{err}}", err)
+	}
+	return config, nil
+}
+
+func (b *backend) configRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	policies := map[string]int64{}
+	for prefix, period := range config.RotationPolicies {
+		policies[prefix] = int64(period.Seconds())
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"max_versions":       config.maxVersions(),
+			"cas_required":       config.CASRequired,
+			"decryption_mode":    config.decryptionMode(),
+			"underscore_policy":  config.underscorePolicy(),
+			"deletion_retention": int64(config.DeletionRetention.Seconds()),
+			"rotation_period":    int64(config.RotationPeriod.Seconds()),
+			"rotation_policies":  policies,
+		},
+	}, nil
+}
+
+// parseRotationPeriod parses a rotation period, which may be given in days as
+// well as anything parseutil.ParseDurationSecond accepts.
+func parseRotationPeriod(in string) (time.Duration, error) {
+	var period time.Duration
+	if strings.HasSuffix(in, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(in, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid rotation period %q", in)
+		}
+		period = time.Duration(days) * 24 * time.Hour
+	} else {
+		var err error
+		period, err = parseutil.ParseDurationSecond(in)
+		if err != nil {
+			return 0, fmt.Errorf("invalid rotation period %q", in)
+		}
+	}
+	if period < 0 {
+		return 0, fmt.Errorf("rotation period %q cannot be negative", in)
+	}
+	return period, nil
+}
+
+func (b *backend) configWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxVersions, ok := data.GetOk("max_versions"); ok {
+		if maxVersions.(int) < 0 {
+			return logical.ErrorResponse("max_versions cannot be negative"), logical.ErrInvalidRequest
+		}
+		config.MaxVersions = maxVersions.(int)
+	}
+	if casRequired, ok := data.GetOk("cas_required"); ok {
+		config.CASRequired = casRequired.(bool)
+	}
+	if retention, ok := data.GetOk("deletion_retention"); ok {
+		if retention.(int) < 0 {
+			return logical.ErrorResponse("deletion_retention cannot be negative"), logical.ErrInvalidRequest
+		}
+		config.DeletionRetention = time.Duration(retention.(int)) * time.Second
+	}
+	if period, ok := data.GetOk("rotation_period"); ok {
+		config.RotationPeriod, err = parseRotationPeriod(period.(string))
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		}
+	}
+	if policies, ok := data.GetOk("rotation_policies"); ok {
+		config.RotationPolicies = map[string]time.Duration{}
+		for prefix, period := range policies.(map[string]string) {
+			if prefix == "" {
+				return logical.ErrorResponse("rotation_policies need a prefix, use rotation_period for the whole mount"), logical.ErrInvalidRequest
+			}
+			config.RotationPolicies[prefix], err = parseRotationPeriod(period)
+			if err != nil {
+				return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+			}
+		}
+	}
+
+	if policy, ok := data.GetOk("underscore_policy"); ok {
+		switch policy.(string) {
+		case underscorePolicyTopLevel, underscorePolicyAll, underscorePolicyNone:
+			config.UnderscorePolicy = policy.(string)
+		default:
+			return logical.ErrorResponse("underscore_policy must be one of %q, %q or %q", underscorePolicyTopLevel, underscorePolicyAll, underscorePolicyNone), logical.ErrInvalidRequest
+		}
+	}
+
+	previousMode := config.decryptionMode()
+	if mode, ok := data.GetOk("decryption_mode"); ok {
+		switch mode.(string) {
+		case decryptionModeStored, decryptionModeLazy:
+			config.DecryptionMode = mode.(string)
+		default:
+			return logical.ErrorResponse("decryption_mode must be either %q or %q", decryptionModeStored, decryptionModeLazy), logical.ErrInvalidRequest
+		}
+	}
+
+	entry, err := logical.StorageEntryJSON(configPath, config)
+	if err != nil {
+		return nil, err
+	}
+
+	b.Logger().Info("storing config at", "path", configPath)
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+	b.decryptedCache.Purge()
+
+	if config.decryptionMode() != previousMode {
+		if err := b.migrateDecryptionMode(ctx, req.Storage, config); err != nil {
+			return nil, errwrap.Wrapf("failed to migrate stored documents: {{err}}", err)
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,121 @@
+package secretsejson
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestEJSON_Config_Default(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config",
+		Storage:   storage,
+	}
+
+	respRead, err := b.HandleRequest(context.Background(), reqRead)
+	if err != nil || (respRead != nil && respRead.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRead)
+	}
+
+	if respRead.Data["max_versions"] != defaultMaxVersions {
+		t.Fatalf("Bad max_versions: \nGot: %#v\nWant: %#v", respRead.Data["max_versions"], defaultMaxVersions)
+	}
+}
+
+func TestEJSON_Config_Write(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	reqWrite := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"max_versions": 3,
+		},
+	}
+
+	respWrite, err := b.HandleRequest(context.Background(), reqWrite)
+	if err != nil || (respWrite != nil && respWrite.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respWrite)
+	}
+
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config",
+		Storage:   storage,
+	}
+
+	respRead, err := b.HandleRequest(context.Background(), reqRead)
+	if err != nil || (respRead != nil && respRead.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRead)
+	}
+
+	if respRead.Data["max_versions"] != 3 {
+		t.Fatalf("Bad max_versions: \nGot: %#v\nWant: %#v", respRead.Data["max_versions"], 3)
+	}
+
+	reqWrite.Data["max_versions"] = -1
+	respWrite, err = b.HandleRequest(context.Background(), reqWrite)
+	if err == nil || respWrite == nil || !respWrite.IsError() {
+		t.Fatalf("expected negative max_versions to be rejected, resp:%#v", respWrite)
+	}
+}
+
+func TestEJSON_Config_RotationPeriod(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	reqWrite := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"rotation_period": "90d",
+			"rotation_policies": map[string]interface{}{
+				"payments/": "30d",
+				"legacy/":   "0",
+			},
+		},
+	}
+
+	respWrite, err := b.HandleRequest(context.Background(), reqWrite)
+	if err != nil || (respWrite != nil && respWrite.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respWrite)
+	}
+
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config",
+		Storage:   storage,
+	}
+
+	respRead, err := b.HandleRequest(context.Background(), reqRead)
+	if err != nil || (respRead != nil && respRead.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRead)
+	}
+
+	if respRead.Data["rotation_period"] != int64(90*24*60*60) {
+		t.Fatalf("Bad rotation_period: \nGot: %#v\nWant: %#v", respRead.Data["rotation_period"], 90*24*60*60)
+	}
+	policies := map[string]int64{
+		"payments/": 30 * 24 * 60 * 60,
+		"legacy/":   0,
+	}
+	if !reflect.DeepEqual(respRead.Data["rotation_policies"], policies) {
+		t.Fatalf("Bad rotation_policies: \nGot: %#v\nWant: %#v", respRead.Data["rotation_policies"], policies)
+	}
+
+	for _, period := range []string{"-1d", "90x", "d"} {
+		reqWrite.Data = map[string]interface{}{
+			"rotation_period": period,
+		}
+		respWrite, err = b.HandleRequest(context.Background(), reqWrite)
+		if err == nil || respWrite == nil || !respWrite.IsError() {
+			t.Fatalf("expected rotation_period %q to be rejected, resp:%#v", period, respWrite)
+		}
+	}
+}
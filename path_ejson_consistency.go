@@ -0,0 +1,73 @@
+package secretsejson
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func ejsonConsistencyPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "consistency",
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.consistencyCheck,
+				logical.CreateOperation: b.consistencyRepair,
+				logical.UpdateOperation: b.consistencyRepair,
+			},
+		},
+	}
+}
+
+// consistencyCheck reports every stored document whose encrypted and
+// decrypted entries disagree, without changing anything.
+func (b *backend) consistencyCheck(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	return b.consistency(ctx, req, false)
+}
+
+// consistencyRepair reports and repairs every stored document whose encrypted
+// and decrypted entries disagree.
+func (b *backend) consistencyRepair(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	return b.consistency(ctx, req, true)
+}
+
+func (b *backend) consistency(ctx context.Context, req *logical.Request, repair bool) (*logical.Response, error) {
+	paths, err := listDocuments(ctx, req.Storage, documentPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	inconsistent := map[string]interface{}{}
+	failed := map[string]interface{}{}
+	for _, path := range paths {
+		problem, err := b.checkOrRepairDocument(ctx, req.Storage, path, repair)
+		if err != nil {
+			failed[documentName(path)] = err.Error()
+			continue
+		}
+		if problem != "" {
+			inconsistent[documentName(path)] = problem
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"documents":    len(paths),
+			"inconsistent": inconsistent,
+			"failed":       failed,
+			"repaired":     repair,
+		},
+	}, nil
+}
+
+func (b *backend) checkOrRepairDocument(ctx context.Context, s logical.Storage, path string, repair bool) (string, error) {
+	unlock := b.lockDocument(path)
+	defer unlock()
+
+	if repair {
+		return b.repairDocument(ctx, s, path)
+	}
+	problem, _, err := b.checkDocument(ctx, s, path)
+	return problem, err
+}
@@ -0,0 +1,109 @@
+package secretsejson
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestEJSON_Consistency_Repair(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+	EJSON_Document_Write(t, b, storage, "other/secret", 1)
+
+	// Simulate a write that stored new ciphertext but failed before the plaintext
+	if err := storage.Put(context.Background(), &logical.StorageEntry{
+		Key:   "docs/itsasecret/decrypted",
+		Value: []byte(`{"asecret":"stale","anumber":1}`),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	reqCheck := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "consistency",
+		Storage:   storage,
+	}
+
+	respCheck, err := b.HandleRequest(context.Background(), reqCheck)
+	if err != nil || (respCheck != nil && respCheck.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respCheck)
+	}
+
+	if respCheck.Data["documents"] != 2 {
+		t.Fatalf("Bad document count: \nGot: %#v\nWant: %#v", respCheck.Data["documents"], 2)
+	}
+	inconsistent := map[string]interface{}{
+		"itsasecret": "plaintext does not match ciphertext",
+	}
+	if !reflect.DeepEqual(respCheck.Data["inconsistent"], inconsistent) {
+		t.Fatalf("Bad consistency report: \nGot: %#v\nWant: %#v", respCheck.Data["inconsistent"], inconsistent)
+	}
+
+	reqRepair := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "consistency",
+		Storage:   storage,
+	}
+
+	respRepair, err := b.HandleRequest(context.Background(), reqRepair)
+	if err != nil || (respRepair != nil && respRepair.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRepair)
+	}
+
+	respCheck, err = b.HandleRequest(context.Background(), reqCheck)
+	if err != nil || (respCheck != nil && respCheck.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respCheck)
+	}
+	if len(respCheck.Data["inconsistent"].(map[string]interface{})) != 0 {
+		t.Fatalf("documents still inconsistent after repair: %#v", respCheck.Data["inconsistent"])
+	}
+}
+
+func TestEJSON_Consistency_WALReplay(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+
+	// Simulate a write of version 2 that was interrupted before its metadata
+	if _, err := framework.PutWAL(context.Background(), storage, walKindStoreDocument, &documentWAL{
+		Path:    "docs/itsasecret",
+		Version: 2,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(context.Background(), &logical.StorageEntry{
+		Key:   "docs/itsasecret/versions/2",
+		Value: []byte(`{}`),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Initialize(context.Background(), &logical.InitializationRequest{Storage: storage}); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := storage.Get(context.Background(), "docs/itsasecret/versions/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry != nil {
+		t.Fatalf("partial version still in storage: %#v", entry)
+	}
+
+	wals, err := framework.ListWAL(context.Background(), storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wals) != 0 {
+		t.Fatalf("WAL entries left after replay: %#v", wals)
+	}
+}
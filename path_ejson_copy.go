@@ -11,6 +11,33 @@ import (
 )
 
 func ejsonCopyPaths(b *backend) []*framework.Path {
+	documentFields := map[string]*framework.FieldSchema{
+		"path": {
+			Type:        framework.TypeString,
+			Description: "Path of the stored document to copy",
+		},
+		"version": {
+			Type:        framework.TypeInt,
+			Description: "Version of the document to copy, defaults to the current version",
+		},
+		"destination": {
+			Type:        framework.TypeString,
+			Description: "Path to store the copy at, not checked against the policies of the caller",
+		},
+		"public_key": {
+			Type:        framework.TypeString,
+			Description: "Active public key stored in keys/ to encrypt the copy with, defaults to the key of the document",
+		},
+		"public_keys": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "Active public keys stored in keys/ to return a copy encrypted with each of, instead of storing it",
+		},
+		"cas": {
+			Type:        framework.TypeInt,
+			Description: "Current version of the document at destination, the copy is rejected if it does not match",
+		},
+	}
+
 	return []*framework.Path{
 		{
 			Pattern: "copy",
@@ -29,6 +56,20 @@ func ejsonCopyPaths(b *backend) []*framework.Path {
 				logical.UpdateOperation: b.copy,
 			},
 		},
+		{
+			Pattern: documentPrefix + "(?P<path>.+)/copy",
+			Fields:  documentFields,
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.UpdateOperation: b.copyDocument,
+			},
+		},
+		{
+			Pattern: "(?P<path>" + unprefixedName + ")/copy",
+			Fields:  documentFields,
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.UpdateOperation: b.copyDocument,
+			},
+		},
 	}
 }
 
@@ -43,7 +84,7 @@ func (b *backend) copy(ctx context.Context, req *logical.Request, data *framewor
 		return nil, errwrap.Wrapf("failed to marshal json: {{err}}", err)
 	}
 
-	decDoc, err := DecryptEjsonDocument(ctx, req, encData)
+	decDoc, err := b.decryptEjsonDocument(ctx, req, encData)
 	if err != nil {
 		return nil, err
 	}
@@ -56,13 +97,16 @@ func (b *backend) copy(ctx context.Context, req *logical.Request, data *framewor
 	path := fmt.Sprintf("keys/%s", publicKeyData)
 	b.Logger().Info(fmt.Sprintf("Encrypting with key pair at %s", path))
 
-	keyPair, err := req.Storage.Get(ctx, path)
+	keyPair, err := getKey(ctx, req.Storage, publicKeyData.(string))
 	if err != nil {
 		return nil, fmt.Errorf("failed to find keypair at path %s: %s", path, err)
 	}
 	if keyPair == nil {
 		return nil, fmt.Errorf("failed to find keypair in %s", path)
 	}
+	if !keyPair.canEncrypt() {
+		return logical.ErrorResponse(fmt.Sprintf("key %s is %s and cannot be used to encrypt", path, keyPair.state())), logical.ErrInvalidRequest
+	}
 
 	decDoc[ej.PublicKeyField] = publicKeyData
 
@@ -77,3 +121,84 @@ func (b *backend) copy(ctx context.Context, req *logical.Request, data *framewor
 		},
 	}, nil
 }
+
+// copyDocument re-encrypts a stored document and either stores it at another
+// path or returns one copy per public key, so its plaintext never leaves Vault.
+func (b *backend) copyDocument(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("path").(string)
+	if resp, err := b.checkDocumentPath(req, name); resp != nil || err != nil {
+		return resp, err
+	}
+	path := documentKey(name)
+
+	destination := documentName(data.Get("destination").(string))
+	publicKeys := data.Get("public_keys").([]string)
+	switch {
+	case destination != "" && len(publicKeys) > 0:
+		return logical.ErrorResponse("destination and public_keys are mutually exclusive"), logical.ErrInvalidRequest
+	case destination == "" && len(publicKeys) == 0:
+		return logical.ErrorResponse("no destination or public_keys provided"), logical.ErrInvalidRequest
+	case destination == name:
+		return logical.ErrorResponse("destination is the copied document, use rotate to re-encrypt it"), logical.ErrInvalidRequest
+	}
+	if _, ok := data.GetOk("public_key"); ok && len(publicKeys) > 0 {
+		return logical.ErrorResponse("public_key and public_keys are mutually exclusive"), logical.ErrInvalidRequest
+	}
+
+	key := path
+	if version := data.Get("version").(int); version > 0 {
+		if resp, err := checkNotDeleted(ctx, req.Storage, path); resp != nil || err != nil {
+			return resp, err
+		}
+		key = versionKey(path, version)
+	}
+
+	entry, err := req.Storage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return logical.ErrorResponse(fmt.Sprintf("failed to find document at %s", name)), nil
+	}
+
+	if destination != "" {
+		public := data.Get("public_key").(string)
+		if public == "" {
+			if public, err = documentPublicKey(entry.Value); err != nil {
+				return nil, err
+			}
+		}
+		publicKeys = []string{public}
+	}
+	for _, public := range publicKeys {
+		if resp, err := checkPublicKey(ctx, req.Storage, public); resp != nil || err != nil {
+			return resp, err
+		}
+	}
+
+	decDoc, err := b.decryptEjsonDocument(ctx, req, entry.Value)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to decrypt ejson: {{err}}", err)
+	}
+
+	copies := make(map[string]interface{}, len(publicKeys))
+	for _, public := range publicKeys {
+		decDoc[ej.PublicKeyField] = public
+		encDoc, err := EncryptEjsonDocument(ctx, decDoc)
+		if err != nil {
+			return nil, errwrap.Wrapf("failed to encrypt ejson: {{err}}", err)
+		}
+		copies[public] = encDoc
+	}
+
+	if destination != "" {
+		b.Logger().Info("copying document", "path", name, "destination", destination, "public_key", publicKeys[0])
+		return b.putDocument(ctx, req, data, destination, copies[publicKeys[0]])
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"documents": copies,
+		},
+	}, nil
+}
@@ -25,7 +25,7 @@ func TestEJSON_Keys_Copy(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	publicKey := "65f9592efefdf0e98df1c9e9b0742ff974705db8921e8a2da5810623f2c83851"
+	publicKey := "f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f"
 
 	dataInput := map[string]interface{}{
 		"document":   string(ejsonDocBytes),
@@ -53,3 +53,188 @@ func TestEJSON_Keys_Copy(t *testing.T) {
 		t.Fatalf("public key does not match provided public key:\n Got:      %#v\n Expected: %#v\n", copiedDoc[ej.PublicKeyField], publicKey)
 	}
 }
+
+func TestEJSON_Copy_StoredDocument(t *testing.T) {
+	b, storage := getTestBackend(t)
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "staging/itsasecret", 1)
+	EJSON_Document_Write(t, b, storage, "staging/itsasecret", 2)
+
+	publicKey := "f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f"
+
+	reqCopy := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "staging/itsasecret/copy",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"destination": "docs/production/itsasecret",
+			"public_key":  publicKey,
+			"version":     1,
+			"cas":         0,
+		},
+	}
+
+	respCopy, err := b.HandleRequest(context.Background(), reqCopy)
+	if err != nil || (respCopy != nil && respCopy.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respCopy)
+	}
+	if respCopy.Data["version"] != 1 {
+		t.Fatalf("Bad version: \nGot: %#v\nWant: %#v", respCopy.Data["version"], 1)
+	}
+
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "production/itsasecret/decrypted",
+		Storage:   storage,
+	}
+
+	respRead, err := b.HandleRequest(context.Background(), reqRead)
+	if err != nil || (respRead != nil && respRead.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRead)
+	}
+
+	expected := map[string]interface{}{
+		"asecret": "ohai",
+		"anumber": float64(1),
+	}
+	if !reflect.DeepEqual(respRead.Data["ejson"], expected) {
+		t.Fatalf("Bad copy: \nGot: %#v\nWant: %#v", respRead.Data["ejson"], expected)
+	}
+
+	meta, err := getDocumentMetadata(context.Background(), storage, "docs/production/itsasecret")
+	if err != nil || meta == nil {
+		t.Fatalf("copy metadata not stored, err:%s meta:%#v\n", err, meta)
+	}
+	if meta.PublicKey != publicKey {
+		t.Fatalf("Bad public key: \nGot: %#v\nWant: %#v", meta.PublicKey, publicKey)
+	}
+
+	// The destination now exists, so cas=0 rejects a second copy
+	respCopy, err = b.HandleRequest(context.Background(), reqCopy)
+	if err == nil && (respCopy == nil || !respCopy.IsError()) {
+		t.Fatalf("copy over an existing document was not rejected: %#v", respCopy)
+	}
+}
+
+func TestEJSON_Copy_StoredDocument_PublicKeys(t *testing.T) {
+	b, storage := getTestBackend(t)
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "staging/itsasecret", 1)
+
+	publicKeys := []string{
+		"15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		"f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f",
+	}
+
+	reqCopy := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "staging/itsasecret/copy",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"public_keys": publicKeys,
+		},
+	}
+
+	respCopy, err := b.HandleRequest(context.Background(), reqCopy)
+	if err != nil || (respCopy != nil && respCopy.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respCopy)
+	}
+
+	copies, ok := respCopy.Data["documents"].(map[string]interface{})
+	if !ok || len(copies) != len(publicKeys) {
+		t.Fatalf("Bad documents: %#v", respCopy.Data["documents"])
+	}
+	for _, publicKey := range publicKeys {
+		copiedDoc, ok := copies[publicKey].(map[string]interface{})
+		if !ok {
+			t.Fatalf("copy for %s missing from response: %#v", publicKey, copies)
+		}
+		if copiedDoc[ej.PublicKeyField] != publicKey {
+			t.Fatalf("Bad public key: \nGot: %#v\nWant: %#v", copiedDoc[ej.PublicKeyField], publicKey)
+		}
+
+		copiedData, err := MarshalForEjson(copiedDoc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decData, err := DecryptEjson(context.Background(), copiedData, storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decrypted map[string]interface{}
+		if err := json.Unmarshal(decData, &decrypted); err != nil {
+			t.Fatal(err)
+		}
+		if decrypted["asecret"] != "ohai" {
+			t.Fatalf("Bad decrypted secret: %#v", decrypted["asecret"])
+		}
+	}
+
+	storedDocs, err := storage.List(context.Background(), "docs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(storedDocs, []string{"staging/"}) {
+		t.Fatalf("copies stored: %#v", storedDocs)
+	}
+}
+
+func TestEJSON_Copy_StoredDocument_Invalid(t *testing.T) {
+	b, storage := getTestBackend(t)
+	EJSON_Keys_Setup(t, b, storage)
+	setKeyState(t, b, storage, "f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f", keyStateDecryptOnly)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+
+	invalidInputs := []struct {
+		path string
+		data map[string]interface{}
+	}{
+		{"itsasecret/copy", map[string]interface{}{}},
+		{"missing/copy", map[string]interface{}{
+			"destination": "other",
+		}},
+		{"itsasecret/copy", map[string]interface{}{
+			"destination": "docs/itsasecret",
+		}},
+		{"itsasecret/copy", map[string]interface{}{
+			"destination": "other",
+			"public_keys": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		}},
+		{"itsasecret/copy", map[string]interface{}{
+			"public_key":  "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+			"public_keys": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		}},
+		{"itsasecret/copy", map[string]interface{}{
+			"destination": "other/decrypted",
+		}},
+		{"itsasecret/copy", map[string]interface{}{
+			"public_keys": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56,f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f",
+		}},
+		{"itsasecret/copy", map[string]interface{}{
+			"destination": "other",
+			"public_key":  "a5c0b19e7a8b2b7e0b0c0e3b47a6f2bde8f4d3b2f1e0c9d8b7a6f5e4d3c2b1a0",
+		}},
+	}
+
+	for _, input := range invalidInputs {
+		reqCopy := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      input.path,
+			Storage:   storage,
+			Data:      input.data,
+		}
+
+		respCopy, err := b.HandleRequest(context.Background(), reqCopy)
+		if err == nil && (respCopy == nil || !respCopy.IsError()) {
+			t.Fatalf("copy of %s with %#v was not rejected: %#v", input.path, input.data, respCopy)
+		}
+	}
+
+	entry, err := storage.Get(context.Background(), "docs/other")
+	if err != nil || entry != nil {
+		t.Fatalf("rejected copy stored, err:%s entry:%#v\n", err, entry)
+	}
+}
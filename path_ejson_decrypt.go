@@ -40,7 +40,7 @@ func (b *backend) decrypt(ctx context.Context, req *logical.Request, data *frame
 		return nil, errwrap.Wrapf("failed to marshall json: {{err}}", err)
 	}
 
-	decData, err := DecryptEjsonDocument(ctx, req, encData)
+	decData, err := b.decryptEjsonDocument(ctx, req, encData)
 	if err != nil {
 		return nil, errwrap.Wrapf("failed to decrypt ejson: {{err}}", err)
 	}
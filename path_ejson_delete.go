@@ -0,0 +1,97 @@
+package secretsejson
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func ejsonDeletePaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: documentPattern(".+", "/undelete"),
+			Fields: map[string]*framework.FieldSchema{
+				"path": {
+					Type:        framework.TypeString,
+					Description: "Path of the deleted document",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.undelete,
+				logical.UpdateOperation: b.undelete,
+			},
+		},
+		{
+			Pattern: documentPattern(".+", "/destroy"),
+			Fields: map[string]*framework.FieldSchema{
+				"path": {
+					Type:        framework.TypeString,
+					Description: "Path of the stored document",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.destroy,
+				logical.UpdateOperation: b.destroy,
+			},
+		},
+	}
+}
+
+func (b *backend) undelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("path").(string)
+	if resp, err := b.checkDocumentPath(req, name); resp != nil || err != nil {
+		return resp, err
+	}
+	path := documentKey(name)
+
+	unlock := b.lockDocument(path)
+	defer unlock()
+
+	b.Logger().Info("undeleting document", "path", name)
+	meta, err := b.undeleteDocument(ctx, req.Storage, path)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return logical.ErrorResponse(fmt.Sprintf("failed to find deleted document at %s", name)), nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"version": meta.CurrentVersion,
+		},
+	}, nil
+}
+
+func (b *backend) destroy(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("path").(string)
+	if resp, err := b.checkDocumentPath(req, name); resp != nil || err != nil {
+		return resp, err
+	}
+	path := documentKey(name)
+
+	unlock := b.lockDocument(path)
+	defer unlock()
+
+	b.Logger().Info("destroying document", "path", name)
+	if err := b.deleteDocument(ctx, req.Storage, path); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// checkNotDeleted returns an error response when the document at path is soft
+// deleted, so its versions cannot be read around the deletion.
+func checkNotDeleted(ctx context.Context, s logical.Storage, path string) (*logical.Response, error) {
+	meta, err := getDocumentMetadata(ctx, s, path)
+	if err != nil {
+		return nil, err
+	}
+	if meta != nil && meta.deleted() {
+		return logical.ErrorResponse(fmt.Sprintf("document at %s is deleted", documentName(path))), nil
+	}
+	return nil, nil
+}
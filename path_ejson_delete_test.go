@@ -0,0 +1,261 @@
+package secretsejson
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func EJSON_Document_Delete(t *testing.T, b logical.Backend, storage logical.Storage, path string) {
+	reqDelete := &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      path,
+		Storage:   storage,
+	}
+
+	respDelete, err := b.HandleRequest(context.Background(), reqDelete)
+	if err != nil || (respDelete != nil && respDelete.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respDelete)
+	}
+}
+
+func TestEJSON_Delete_Undelete(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+	EJSON_Document_Write(t, b, storage, "itsasecret", 2)
+	EJSON_Document_Delete(t, b, storage, "itsasecret")
+
+	for _, path := range []string{"itsasecret", "itsasecret/decrypted"} {
+		reqRead := &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      path,
+			Storage:   storage,
+		}
+
+		respRead, err := b.HandleRequest(context.Background(), reqRead)
+		if err != nil {
+			t.Fatalf("err:%s resp:%#v\n", err, respRead)
+		}
+		if respRead != nil && !respRead.IsError() {
+			t.Fatalf("Read data that was supposed to be deleted: \n%#v", respRead)
+		}
+	}
+
+	reqReadVersion := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "itsasecret/decrypted",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"version": 1,
+		},
+	}
+
+	respReadVersion, err := b.HandleRequest(context.Background(), reqReadVersion)
+	if err != nil {
+		t.Fatalf("err:%s resp:%#v\n", err, respReadVersion)
+	}
+	if respReadVersion == nil || !respReadVersion.IsError() {
+		t.Fatalf("Read version of a deleted document: \n%#v", respReadVersion)
+	}
+
+	reqMetadata := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "itsasecret/metadata",
+		Storage:   storage,
+	}
+
+	respMetadata, err := b.HandleRequest(context.Background(), reqMetadata)
+	if err != nil || (respMetadata != nil && respMetadata.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respMetadata)
+	}
+	if respMetadata.Data["deleted_time"].(time.Time).IsZero() {
+		t.Fatalf("deleted_time not set on deleted document")
+	}
+
+	reqUndelete := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "itsasecret/undelete",
+		Storage:   storage,
+	}
+
+	respUndelete, err := b.HandleRequest(context.Background(), reqUndelete)
+	if err != nil || (respUndelete != nil && respUndelete.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respUndelete)
+	}
+	if respUndelete.Data["version"] != 2 {
+		t.Fatalf("Bad undeleted version: \nGot: %#v\nWant: %#v", respUndelete.Data["version"], 2)
+	}
+
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "itsasecret/decrypted",
+		Storage:   storage,
+	}
+
+	respRead, err := b.HandleRequest(context.Background(), reqRead)
+	if err != nil || (respRead != nil && respRead.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRead)
+	}
+
+	dataDec := map[string]interface{}{
+		"asecret": "ohai",
+		"anumber": float64(2),
+	}
+	if !reflect.DeepEqual(respRead.Data["ejson"], dataDec) {
+		t.Fatalf("Bad undeleted document: \nGot: %#v\nWant: %#v", respRead.Data["ejson"], dataDec)
+	}
+
+	respUndelete, err = b.HandleRequest(context.Background(), reqUndelete)
+	if err != nil {
+		t.Fatalf("err:%s resp:%#v\n", err, respUndelete)
+	}
+	if respUndelete == nil || !respUndelete.IsError() {
+		t.Fatalf("Undeleted a document that is not deleted: \n%#v", respUndelete)
+	}
+}
+
+func TestEJSON_Delete_Destroy(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+
+	reqDestroy := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "itsasecret/destroy",
+		Storage:   storage,
+	}
+
+	respDestroy, err := b.HandleRequest(context.Background(), reqDestroy)
+	if err != nil || (respDestroy != nil && respDestroy.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respDestroy)
+	}
+
+	keys, err := storage.List(context.Background(), "docs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("entries left after destroying document: %#v", keys)
+	}
+}
+
+func TestEJSON_Delete_ReservedName(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+
+	for _, path := range []string{"itsasecret/decrypted", "docs/itsasecret/decrypted", "itsasecret//other"} {
+		reqDelete := &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      path,
+			Storage:   storage,
+		}
+
+		respDelete, err := b.HandleRequest(context.Background(), reqDelete)
+		if err == nil && (respDelete == nil || !respDelete.IsError()) {
+			t.Fatalf("delete of %s was not rejected: %#v", path, respDelete)
+		}
+	}
+
+	keys, err := storage.List(context.Background(), "docs/itsasecret/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"decrypted", "metadata", "versions/"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Bad entries: \nGot: %#v\nWant: %#v", keys, expected)
+	}
+}
+
+func TestEJSON_Delete_VersionsPath(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+	EJSON_Document_Delete(t, b, storage, "itsasecret")
+
+	for _, path := range []string{"itsasecret/versions/1", "itsasecret/versions/1/decrypted", "itsasecret/versions/1/decrypted/field/asecret", "itsasecret/metadata/decrypted"} {
+		reqRead := &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      path,
+			Storage:   storage,
+		}
+
+		respRead, err := b.HandleRequest(context.Background(), reqRead)
+		if err != logical.ErrInvalidRequest || respRead == nil || !respRead.IsError() {
+			t.Fatalf("read of %s was not rejected: %#v, %v", path, respRead, err)
+		}
+	}
+}
+
+func TestEJSON_Delete_Purge(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	reqConfig := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"deletion_retention": "1h",
+		},
+	}
+
+	respConfig, err := b.HandleRequest(context.Background(), reqConfig)
+	if err != nil || (respConfig != nil && respConfig.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respConfig)
+	}
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+	EJSON_Document_Write(t, b, storage, "other/secret", 1)
+	EJSON_Document_Delete(t, b, storage, "itsasecret")
+	EJSON_Document_Delete(t, b, storage, "other/secret")
+
+	// Backdate the deletion of one document beyond the retention
+	meta, err := getDocumentMetadata(context.Background(), storage, "docs/itsasecret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.DeletedTime = time.Now().UTC().Add(-2 * time.Hour)
+	if err := putDocumentMetadata(context.Background(), storage, "docs/itsasecret", meta); err != nil {
+		t.Fatal(err)
+	}
+
+	reqRollback := &logical.Request{
+		Operation: logical.RollbackOperation,
+		Path:      "",
+		Storage:   storage,
+	}
+
+	if _, err := b.HandleRequest(context.Background(), reqRollback); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err = getDocumentMetadata(context.Background(), storage, "docs/itsasecret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta != nil {
+		t.Fatalf("deleted document not purged after retention: %#v", meta)
+	}
+
+	meta, err = getDocumentMetadata(context.Background(), storage, "docs/other/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta == nil || !meta.deleted() {
+		t.Fatalf("deleted document purged within retention: %#v", meta)
+	}
+}
@@ -0,0 +1,167 @@
+package secretsejson
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func ejsonEncryptPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "encrypt",
+			Fields: map[string]*framework.FieldSchema{
+				"ejson": {
+					Type:        framework.TypeMap,
+					Description: "Plaintext JSON document to encrypt",
+				},
+				"public_key": {
+					Type:        framework.TypeString,
+					Description: "Public key to encrypt with, must be stored in keys/, defaults to the _public_key of the document",
+				},
+				"path": {
+					Type:        framework.TypeString,
+					Description: "Path to store the encrypted document at, optional",
+				},
+				"cas": {
+					Type:        framework.TypeInt,
+					Description: "Current version of the document at path, the write is rejected if it does not match",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.encrypt,
+				logical.UpdateOperation: b.encrypt,
+			},
+		},
+		{
+			Pattern: "encrypt/value",
+			Fields: map[string]*framework.FieldSchema{
+				"public_key": {
+					Type:        framework.TypeString,
+					Description: "Public key to encrypt with, must be stored in keys/",
+				},
+				"plaintext": {
+					Type:        framework.TypeString,
+					Description: "Value to encrypt",
+				},
+				"batch_input": {
+					Type:        framework.TypeStringSlice,
+					Description: "Values to encrypt in a single request, instead of plaintext",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.encryptValue,
+				logical.UpdateOperation: b.encryptValue,
+			},
+		},
+	}
+}
+
+func (b *backend) encrypt(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	inputData, ok := data.GetOk("ejson")
+	if !ok {
+		if resp, err := checkRawParameters(data.Raw, "public_key", "path", "cas"); resp != nil || err != nil {
+			return resp, err
+		}
+		inputData = data.Raw
+	}
+	decData := inputData.(map[string]interface{})
+	if len(decData) == 0 {
+		return logical.ErrorResponse("no data provided"), logical.ErrInvalidRequest
+	}
+
+	// Raw documents, which cannot carry parameters, name their key in
+	// _public_key
+	publicKey := data.Get("public_key").(string)
+	if docKey, ok := decData["_public_key"].(string); ok && publicKey == "" {
+		publicKey = docKey
+	}
+	if resp, err := checkPublicKey(ctx, req.Storage, publicKey); resp != nil || err != nil {
+		return resp, err
+	}
+	if docKey, ok := decData["_public_key"]; ok && docKey != publicKey {
+		return logical.ErrorResponse(fmt.Sprintf("_public_key of the document does not match %s", publicKey)), logical.ErrInvalidRequest
+	}
+
+	doc := make(map[string]interface{}, len(decData)+1)
+	for k, v := range decData {
+		doc[k] = v
+	}
+	doc["_public_key"] = publicKey
+
+	encData, err := EncryptEjsonDocument(ctx, doc)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to encrypt ejson: {{err}}", err)
+	}
+
+	if path, ok := data.GetOk("path"); ok {
+		return b.putDocument(ctx, req, data, documentName(path.(string)), encData)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"ejson": encData,
+		},
+	}, nil
+}
+
+// encryptValue returns single boxed values that can be pasted into an ejson
+// file, rather than a whole document.
+func (b *backend) encryptValue(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	publicKey := data.Get("public_key").(string)
+	if resp, err := checkPublicKey(ctx, req.Storage, publicKey); resp != nil || err != nil {
+		return resp, err
+	}
+
+	plaintext, single := data.GetOk("plaintext")
+	batch, ok := data.GetOk("batch_input")
+	switch {
+	case single && ok:
+		return logical.ErrorResponse("plaintext and batch_input are mutually exclusive"), logical.ErrInvalidRequest
+	case single:
+		batch = []string{plaintext.(string)}
+	case !ok:
+		return logical.ErrorResponse("no plaintext provided"), logical.ErrInvalidRequest
+	}
+
+	boxed, err := EncryptEjsonValues(ctx, publicKey, batch.([]string))
+	if err != nil {
+		return nil, err
+	}
+
+	if single {
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"ciphertext": boxed[0],
+			},
+		}, nil
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"batch_results": boxed,
+		},
+	}, nil
+}
+
+// checkPublicKey returns an error response unless publicKey is stored in keys/
+// and active.
+func checkPublicKey(ctx context.Context, s logical.Storage, publicKey string) (*logical.Response, error) {
+	if publicKey == "" {
+		return logical.ErrorResponse("no public_key provided"), logical.ErrInvalidRequest
+	}
+
+	key, err := getKey(ctx, s, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return logical.ErrorResponse(fmt.Sprintf("failed to find key in keys/%s", publicKey)), logical.ErrInvalidRequest
+	}
+	if !key.canEncrypt() {
+		return logical.ErrorResponse(fmt.Sprintf("key keys/%s is %s and cannot be used to encrypt", publicKey, key.state())), logical.ErrInvalidRequest
+	}
+	return nil, nil
+}
@@ -0,0 +1,256 @@
+package secretsejson
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestEJSON_Encrypt(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "encrypt",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+			"ejson": map[string]interface{}{
+				"asecret":  "ohai",
+				"_bsecret": "orly",
+			},
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	encDoc := resp.Data["ejson"].(map[string]interface{})
+	if encDoc["_public_key"] != "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56" {
+		t.Fatalf("Bad public key: %#v", encDoc["_public_key"])
+	}
+	if !strings.HasPrefix(encDoc["asecret"].(string), "EJ[") {
+		t.Fatalf("Value not encrypted: %#v", encDoc["asecret"])
+	}
+	if encDoc["_bsecret"] != "orly" {
+		t.Fatalf("Underscored value changed: %#v", encDoc["_bsecret"])
+	}
+
+	reqDecrypt := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "decrypt",
+		Storage:   storage,
+		Data:      encDoc,
+	}
+
+	respDecrypt, err := b.HandleRequest(context.Background(), reqDecrypt)
+	if err != nil || (respDecrypt != nil && respDecrypt.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respDecrypt)
+	}
+	if respDecrypt.Data["asecret"] != "ohai" {
+		t.Fatalf("Bad decryption response: %#v", respDecrypt.Data)
+	}
+}
+
+func TestEJSON_Encrypt_Store(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "encrypt",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+			"path":       "itsasecret",
+			"ejson": map[string]interface{}{
+				"asecret": "ohai",
+			},
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+	if resp.Data["version"] != 1 {
+		t.Fatalf("Bad version: \nGot: %#v\nWant: %#v", resp.Data["version"], 1)
+	}
+
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "itsasecret/decrypted",
+		Storage:   storage,
+	}
+
+	respRead, err := b.HandleRequest(context.Background(), reqRead)
+	if err != nil || (respRead != nil && respRead.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRead)
+	}
+
+	dataDec := map[string]interface{}{
+		"asecret": "ohai",
+	}
+	if !reflect.DeepEqual(respRead.Data["ejson"], dataDec) {
+		t.Fatalf("Bad decryption response: \nGot: %#v\nWant: %#v", respRead.Data["ejson"], dataDec)
+	}
+}
+
+func TestEJSON_Encrypt_UnknownKey(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "encrypt",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"public_key": "a5c0b19e7a8b2b7e0b0c0e3b47a6f2bde8f4d3b2f1e0c9d8b7a6f5e4d3c2b1a0",
+			"ejson": map[string]interface{}{
+				"asecret": "ohai",
+			},
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err == nil {
+		t.Fatalf("expected unknown public key to be rejected, resp:%#v", resp)
+	}
+}
+
+func TestEJSON_Encrypt_Value(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "encrypt/value",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+			"plaintext":  "ohai",
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	reqBatch := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "encrypt/value",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"public_key":  "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+			"batch_input": []string{"orly", "yarly"},
+		},
+	}
+
+	respBatch, err := b.HandleRequest(context.Background(), reqBatch)
+	if err != nil || (respBatch != nil && respBatch.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respBatch)
+	}
+	batch := respBatch.Data["batch_results"].([]string)
+	if len(batch) != 2 {
+		t.Fatalf("Bad batch results: %#v", batch)
+	}
+
+	// The boxed values must decrypt as part of an ejson document
+	reqDecrypt := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "decrypt",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"_public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+			"asecret":     resp.Data["ciphertext"],
+			"bsecret":     batch[0],
+			"csecret":     batch[1],
+		},
+	}
+
+	respDecrypt, err := b.HandleRequest(context.Background(), reqDecrypt)
+	if err != nil || (respDecrypt != nil && respDecrypt.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respDecrypt)
+	}
+
+	dataDec := map[string]interface{}{
+		"_public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		"asecret":     "ohai",
+		"bsecret":     "orly",
+		"csecret":     "yarly",
+	}
+	if !reflect.DeepEqual(respDecrypt.Data, dataDec) {
+		t.Fatalf("Bad decryption response: \nGot: %#v\nWant: %#v", respDecrypt.Data, dataDec)
+	}
+}
+
+func TestEJSON_Encrypt_RawParameters(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	// Parameters of a raw document could as well be fields of it
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "encrypt",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+			"path":       "app/settings",
+			"password":   "hunter2",
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != logical.ErrInvalidRequest || resp == nil || !resp.IsError() {
+		t.Fatalf("raw document with parameters was not rejected: err:%s resp:%#v\n", err, resp)
+	}
+
+	entry, err := storage.Get(context.Background(), "docs/app/settings")
+	if err != nil || entry != nil {
+		t.Fatalf("err:%s entry:%#v\n", err, entry)
+	}
+
+	// Without parameters the whole body is the document, encrypted with its
+	// _public_key
+	req.Data = map[string]interface{}{
+		"_public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		"password":    "hunter2",
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	reqDecrypt := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "decrypt",
+		Storage:   storage,
+		Data:      resp.Data["ejson"].(map[string]interface{}),
+	}
+
+	respDecrypt, err := b.HandleRequest(context.Background(), reqDecrypt)
+	if err != nil || (respDecrypt != nil && respDecrypt.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respDecrypt)
+	}
+
+	dataDec := map[string]interface{}{
+		"_public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		"password":    "hunter2",
+	}
+	if !reflect.DeepEqual(respDecrypt.Data, dataDec) {
+		t.Fatalf("Bad decryption response: \nGot: %#v\nWant: %#v", respDecrypt.Data, dataDec)
+	}
+}
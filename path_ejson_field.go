@@ -0,0 +1,122 @@
+package secretsejson
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func ejsonFieldPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: documentPattern(".+", "/decrypted/field/(?P<field>.+)"),
+			Fields: map[string]*framework.FieldSchema{
+				"path": {
+					Type:        framework.TypeString,
+					Description: "Path of the stored document",
+				},
+				"field": {
+					Type:        framework.TypeString,
+					Description: "JSON pointer to the field, without its leading slash",
+				},
+				"version": {
+					Type:        framework.TypeInt,
+					Description: "Version of the document to read, defaults to the current version",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.fieldRead,
+			},
+		},
+	}
+}
+
+func (b *backend) fieldRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("path").(string)
+	if resp, err := b.checkDocumentPath(req, name); resp != nil || err != nil {
+		return resp, err
+	}
+	if err := validateDocumentName(name); err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+	path := documentKey(name)
+	pointer := "/" + data.Get("field").(string)
+
+	return b.readDecryptedField(ctx, req, path, data.Get("version").(int), pointer)
+}
+
+// readDecryptedField returns the single value pointer refers to in the
+// decrypted copy of the document stored at path.
+func (b *backend) readDecryptedField(ctx context.Context, req *logical.Request, path string, version int, pointer string) (*logical.Response, error) {
+	key := path
+	if version > 0 {
+		if resp, err := checkNotDeleted(ctx, req.Storage, path); resp != nil || err != nil {
+			return resp, err
+		}
+		key = versionKey(path, version)
+	}
+
+	sanData, err := b.readPlaintext(ctx, req.Storage, key)
+	if err != nil {
+		return nil, err
+	}
+	if sanData == nil {
+		return logical.ErrorResponse(fmt.Sprintf("failed to find value at %s", decryptedKey(documentName(path)))), nil
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(sanData, &doc); err != nil {
+		return nil, err
+	}
+
+	value, err := resolvePointer(doc, pointer)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	b.Logger().Info("reading field of value at", "path", decryptedKey(key), "field", pointer)
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"field": pointer,
+			"value": value,
+		},
+	}, nil
+}
+
+// resolvePointer returns the value a RFC 6901 JSON pointer refers to in doc.
+func resolvePointer(doc interface{}, pointer string) (interface{}, error) {
+	if pointer == "" {
+		return doc, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("field %q is not a JSON pointer", pointer)
+	}
+
+	value := doc
+	for _, token := range strings.Split(pointer[1:], "/") {
+		token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+
+		switch v := value.(type) {
+		case map[string]interface{}:
+			next, ok := v[token]
+			if !ok {
+				return nil, fmt.Errorf("failed to find field %s", pointer)
+			}
+			value = next
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, fmt.Errorf("failed to find field %s", pointer)
+			}
+			value = v[i]
+		default:
+			return nil, fmt.Errorf("failed to find field %s", pointer)
+		}
+	}
+	return value, nil
+}
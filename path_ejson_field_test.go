@@ -0,0 +1,117 @@
+package secretsejson
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func EJSON_Nested_Document_Write(t *testing.T, b logical.Backend, storage logical.Storage, path string) {
+	encDoc, err := EncryptEjsonDocument(context.Background(), map[string]interface{}{
+		"_public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		"database": map[string]interface{}{
+			"_username": "admin",
+			"password":  "sicher",
+			"hosts":     []interface{}{"primary", "replica"},
+		},
+		"a/b": "slashed",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqWrite := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      path,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"ejson": encDoc,
+		},
+	}
+
+	respWrite, err := b.HandleRequest(context.Background(), reqWrite)
+	if err != nil || (respWrite != nil && respWrite.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respWrite)
+	}
+}
+
+func TestEJSON_Field_Read(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+	EJSON_Nested_Document_Write(t, b, storage, "itsasecret")
+
+	cases := map[string]interface{}{
+		"itsasecret/decrypted/field/database/password":  "sicher",
+		"itsasecret/decrypted/field/database/_username": "admin",
+		"itsasecret/decrypted/field/database/hosts/1":   "replica",
+		"itsasecret/decrypted/field/a~1b":               "slashed",
+	}
+
+	for path, value := range cases {
+		reqRead := &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      path,
+			Storage:   storage,
+		}
+
+		respRead, err := b.HandleRequest(context.Background(), reqRead)
+		if err != nil || (respRead != nil && respRead.IsError()) {
+			t.Fatalf("err:%s resp:%#v\n", err, respRead)
+		}
+
+		if respRead.Data["value"] != value {
+			t.Fatalf("Bad field response for %s: \nGot: %#v\nWant: %#v", path, respRead.Data["value"], value)
+		}
+	}
+}
+
+func TestEJSON_Field_Read_Parameter(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+	EJSON_Nested_Document_Write(t, b, storage, "itsasecret")
+
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "itsasecret/decrypted",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"field": "/database/password",
+		},
+	}
+
+	respRead, err := b.HandleRequest(context.Background(), reqRead)
+	if err != nil || (respRead != nil && respRead.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRead)
+	}
+
+	if respRead.Data["value"] != "sicher" {
+		t.Fatalf("Bad field response: \nGot: %#v\nWant: %#v", respRead.Data["value"], "sicher")
+	}
+	if _, ok := respRead.Data["ejson"]; ok {
+		t.Fatalf("field read returned the whole document: %#v", respRead.Data)
+	}
+}
+
+func TestEJSON_Field_Read_Missing(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+	EJSON_Nested_Document_Write(t, b, storage, "itsasecret")
+
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "itsasecret/decrypted/field/database/nope",
+		Storage:   storage,
+	}
+
+	respRead, err := b.HandleRequest(context.Background(), reqRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if respRead == nil || !respRead.IsError() {
+		t.Fatalf("expected missing field to be an error, resp:%#v", respRead)
+	}
+}
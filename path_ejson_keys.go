@@ -3,27 +3,116 @@ package secretsejson
 import (
 	"context"
 	"fmt"
+	"strings"
+	"time"
 
-	"github.com/Shopify/ejson"
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/crypto/curve25519"
 )
 
+// secretSaltKey is the entry below keys/ holding the salt of /identity rather
+// than a key pair.
+const secretSaltKey = "__secret_salt"
+
+// keyMetadataFields are the settings of a key pair, accepted when storing or
+// generating it and on keys/<public key>/metadata.
+func keyMetadataFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		"name": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "Name or alias of the key pair",
+		},
+		"description": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "Description of the key pair",
+		},
+		"owner": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "Team or person owning the key pair",
+		},
+		"deletion_allowed": &framework.FieldSchema{
+			Type:        framework.TypeBool,
+			Description: "Allow the key pair to be deleted, defaults to true",
+		},
+		"state": &framework.FieldSchema{
+			Type:          framework.TypeString,
+			Description:   "State of the key pair: active, decrypt-only or archived. Defaults to active",
+			AllowedValues: []interface{}{keyStateActive, keyStateDecryptOnly, keyStateArchived},
+		},
+	}
+}
+
 func ejsonKeysPaths(b *backend) []*framework.Path {
+	keyFields := map[string]*framework.FieldSchema{
+		"public": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "EJSON Public key",
+		},
+		"private": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "EJSON Private key",
+		},
+		"exportable": &framework.FieldSchema{
+			Type:        framework.TypeBool,
+			Description: "Allow the private key to be read back, defaults to false",
+		},
+		"force": &framework.FieldSchema{
+			Type:        framework.TypeBool,
+			Description: "Delete the key pair even if stored documents are encrypted with it",
+		},
+	}
+	keyPairFields := map[string]*framework.FieldSchema{
+		"exportable": &framework.FieldSchema{
+			Type:        framework.TypeBool,
+			Description: "Allow the private key to be read back, defaults to false",
+		},
+	}
+	metadataFields := map[string]*framework.FieldSchema{
+		"public": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "EJSON Public key",
+		},
+	}
+	for name, field := range keyMetadataFields() {
+		keyFields[name] = field
+		keyPairFields[name] = field
+		metadataFields[name] = field
+	}
+
 	return []*framework.Path{
 		{
-			Pattern: "keys/.*",
+			// Matched before keys/.* so it is not read as a key pair
+			Pattern: "keys/(?P<public>[^/]+)/metadata",
+			Fields:  metadataFields,
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.keyMetadataRead,
+				logical.UpdateOperation: b.keyMetadataUpdate,
+			},
+		},
+		{
+			Pattern: "keys/(?P<public>[^/]+)/usage",
 			Fields: map[string]*framework.FieldSchema{
 				"public": &framework.FieldSchema{
 					Type:        framework.TypeString,
 					Description: "EJSON Public key",
 				},
-				"private": &framework.FieldSchema{
-					Type:        framework.TypeString,
-					Description: "EJSON Private key",
-				},
 			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.keyUsageRead,
+			},
+		},
+		{
+			Pattern: "reindex",
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.reindexWrite,
+				logical.UpdateOperation: b.reindexWrite,
+			},
+		},
+		{
+			Pattern:        "keys/.*",
+			Fields:         keyFields,
 			ExistenceCheck: b.pathExistenceCheck,
 			Callbacks: map[logical.Operation]framework.OperationFunc{
 				logical.ReadOperation:   b.keyRead,
@@ -35,6 +124,7 @@ func ejsonKeysPaths(b *backend) []*framework.Path {
 		},
 		{
 			Pattern: "keypair",
+			Fields:  keyPairFields,
 			Callbacks: map[logical.Operation]framework.OperationFunc{
 				logical.CreateOperation: b.keyPairCreate,
 				logical.UpdateOperation: b.keyPairCreate,
@@ -53,53 +143,119 @@ func (b *backend) pathExistenceCheck(ctx context.Context, req *logical.Request,
 }
 
 func (b *backend) keyRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	entry, err := req.Storage.Get(ctx, req.Path)
+	key, err := getKey(ctx, req.Storage, strings.TrimPrefix(req.Path, "keys/"))
 	if err != nil {
 		return nil, err
 	}
 
-	if entry == nil {
+	if key == nil {
 		return nil, nil
 	}
 
 	b.Logger().Info("reading value at", "path", req.Path)
-	// Return the secret
 	resp := &logical.Response{
 		Data: map[string]interface{}{
-			"private": nil,
+			"exportable": key.Exportable,
 		},
 	}
 
-	resp.Data["private"] = string(entry.Value)
+	// Only return the secret if the key allows it
+	if key.Exportable {
+		resp.Data["private"] = key.Private
+	}
 
 	return resp, nil
 }
 
 func (b *backend) keyCreateUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	private := data.Get("private").(string)
+	public := strings.TrimPrefix(req.Path, "keys/")
 
-	b.Logger().Info("storing value at", "path", req.Path)
-	entry := &logical.StorageEntry{
-		Key:   req.Path,
-		Value: []byte(private),
+	// The salt of /identity is not a key pair and stays a plain entry
+	if public == secretSaltKey {
+		b.Logger().Info("storing value at", "path", req.Path)
+		if err := req.Storage.Put(ctx, &logical.StorageEntry{
+			Key:   req.Path,
+			Value: []byte(private),
+		}); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	if err := validateKeyPair(public, private); err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	unlock := b.lockDocument(keyPath(public))
+	defer unlock()
+
+	// Storing a key pair again keeps what is known about it
+	key, err := getKey(ctx, req.Storage, public)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case key == nil:
+		key = &keyEntry{CreatedTime: time.Now().UTC()}
+	case key.legacy:
+		// The creation time of key pairs that only held their private key
+		// is unknown
+		key = &keyEntry{}
+	}
+	key.Private = private
+	key.Exportable = data.Get("exportable").(bool)
+	if err := setKeyMetadata(key, data); err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
 	}
 
-	if err := req.Storage.Put(ctx, entry); err != nil {
+	b.Logger().Info("storing value at", "path", req.Path)
+	if err := putKey(ctx, req.Storage, public, key); err != nil {
 		return nil, err
 	}
+	b.decryptedCache.Purge()
 
 	return &logical.Response{
 		Data: map[string]interface{}{
-			"private": private,
+			"exportable": key.Exportable,
 		},
 	}, nil
 }
 
 func (b *backend) keyDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	public := strings.TrimPrefix(req.Path, "keys/")
+	if public != secretSaltKey {
+		unlock := b.lockDocument(keyPath(public))
+		defer unlock()
+
+		key, err := getKey(ctx, req.Storage, public)
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			return nil, nil
+		}
+		if !key.deletionAllowed() {
+			return logical.ErrorResponse(fmt.Sprintf("deletion is not allowed for key %s", public)), logical.ErrInvalidRequest
+		}
+
+		// Without the private key these documents can no longer be decrypted
+		if !data.Get("force").(bool) {
+			documents, err := b.keyUsageDocuments(ctx, req.Storage, public)
+			if err != nil {
+				return nil, err
+			}
+			if len(documents) > 0 {
+				return logical.ErrorResponse(fmt.Sprintf("key %s is used by %d stored documents, see %s/usage or delete with force=true", public, len(documents), keyPath(public))), logical.ErrInvalidRequest
+			}
+		}
+	}
+
 	b.Logger().Info("deleting value at", "path", req.Path)
 	if err := req.Storage.Delete(ctx, req.Path); err != nil {
 		return nil, err
 	}
+	b.decryptedCache.Purge()
 
 	return nil, nil
 }
@@ -109,27 +265,210 @@ func (b *backend) keyList(ctx context.Context, req *logical.Request, data *frame
 	if err != nil {
 		return nil, err
 	}
-	return logical.ListResponse(vals), nil
+
+	keyInfo := map[string]interface{}{}
+	for _, public := range vals {
+		if public == secretSaltKey {
+			continue
+		}
+		key, err := getKey(ctx, req.Storage, public)
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			continue
+		}
+		keyInfo[public] = map[string]interface{}{
+			"name":  key.Name,
+			"state": key.state(),
+		}
+	}
+	return logical.ListResponseWithInfo(vals, keyInfo), nil
 }
 
 func (b *backend) keyPairCreate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	public, private, err := ejson.GenerateKeypair()
+	key := &keyEntry{
+		Exportable: data.Get("exportable").(bool),
+	}
+	if err := setKeyMetadata(key, data); err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	public, err := b.generateKeyPair(ctx, req.Storage, key)
 	if err != nil {
-		return nil, errwrap.Wrapf("failed to generate keypair ejson: {{err}}", err)
+		return nil, err
 	}
-	path := fmt.Sprintf("keys/%s", public)
-	b.Logger().Info(fmt.Sprintf("New key pair at %s", path))
-	entry := &logical.StorageEntry{
-		Key:   path,
-		Value: []byte(private),
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"public":     public,
+			"exportable": key.Exportable,
+		},
+	}, nil
+}
+
+func (b *backend) keyMetadataRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	public := data.Get("public").(string)
+	if resp, err := checkNotSecretSalt(public); resp != nil || err != nil {
+		return resp, err
 	}
-	if err := req.Storage.Put(ctx, entry); err != nil {
+
+	key, err := getKey(ctx, req.Storage, public)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, nil
+	}
+
+	// Include the decryptions that are not in storage yet
+	pending := b.pendingKeyUse(public)
+	lastUsed := key.LastUsedTime
+	if pending.LastUsedTime.After(lastUsed) {
+		lastUsed = pending.LastUsedTime
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"name":             key.Name,
+			"description":      key.Description,
+			"owner":            key.Owner,
+			"exportable":       key.Exportable,
+			"deletion_allowed": key.deletionAllowed(),
+			"state":            key.state(),
+			"created_time":     key.CreatedTime,
+			"last_used_time":   lastUsed,
+			"decrypt_count":    key.DecryptCount + pending.DecryptCount,
+		},
+	}
+	return resp, nil
+}
+
+func (b *backend) keyMetadataUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	public := data.Get("public").(string)
+	if resp, err := checkNotSecretSalt(public); resp != nil || err != nil {
+		return resp, err
+	}
+
+	unlock := b.lockDocument(keyPath(public))
+	defer unlock()
+
+	key, err := getKey(ctx, req.Storage, public)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return logical.ErrorResponse(fmt.Sprintf("failed to find key %s", public)), logical.ErrInvalidRequest
+	}
+	state := key.state()
+	if err := setKeyMetadata(key, data); err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	if err := putKey(ctx, req.Storage, public, key); err != nil {
 		return nil, err
 	}
+	// Plaintext of documents encrypted with an archived key is not served
+	// from the cache either
+	if key.state() != state {
+		b.decryptedCache.Purge()
+	}
+	return nil, nil
+}
+
+// keyUsageRead lists the stored documents with a retained version encrypted
+// with the key, including soft deleted documents.
+func (b *backend) keyUsageRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	public := data.Get("public").(string)
+	if resp, err := checkNotSecretSalt(public); resp != nil || err != nil {
+		return resp, err
+	}
+
+	documents, err := b.keyUsageDocuments(ctx, req.Storage, public)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"documents": documents,
+		},
+	}, nil
+}
+
+// checkNotSecretSalt rejects key pair operations on the salt of /identity,
+// which getKey would otherwise take for a legacy key pair.
+func checkNotSecretSalt(public string) (*logical.Response, error) {
+	if public == secretSaltKey {
+		return logical.ErrorResponse(fmt.Sprintf("keys/%s is not a key pair", secretSaltKey)), logical.ErrInvalidRequest
+	}
+	return nil, nil
+}
+
+// reindexWrite rebuilds the index of documents per key, for mounts written by
+// versions without it or after an interrupted write.
+func (b *backend) reindexWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	added, removed, err := b.reindex(ctx, req.Storage)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to rebuild key index: {{err}}", err)
+	}
 
 	return &logical.Response{
 		Data: map[string]interface{}{
-			"public": public,
+			"added":   added,
+			"removed": removed,
 		},
 	}, nil
 }
+
+// setKeyMetadata applies the settings given in data to key.
+func setKeyMetadata(key *keyEntry, data *framework.FieldData) error {
+	if name, ok := data.GetOk("name"); ok {
+		key.Name = name.(string)
+	}
+	if description, ok := data.GetOk("description"); ok {
+		key.Description = description.(string)
+	}
+	if owner, ok := data.GetOk("owner"); ok {
+		key.Owner = owner.(string)
+	}
+	if allowed, ok := data.GetOk("deletion_allowed"); ok {
+		deletionAllowed := allowed.(bool)
+		key.DeletionAllowed = &deletionAllowed
+	}
+	if state, ok := data.GetOk("state"); ok {
+		switch state.(string) {
+		case keyStateActive, keyStateDecryptOnly, keyStateArchived:
+			key.State = state.(string)
+		default:
+			return fmt.Errorf("invalid state %q, must be one of %s, %s or %s", state, keyStateActive, keyStateDecryptOnly, keyStateArchived)
+		}
+	}
+	return nil
+}
+
+// validateKeyPair checks that private is a hex encoded Curve25519 private key
+// whose public key is public, so a typo cannot surface as a decryption failure
+// later on.
+func validateKeyPair(public string, private string) error {
+	publicKey, err := ParseKey(public)
+	if err != nil {
+		return fmt.Errorf("public key %q is not 64 hex characters", public)
+	}
+	// Documents look their key up by the lowercase hex of their _public_key
+	if canonical := fmt.Sprintf("%x", publicKey); public != canonical {
+		return fmt.Errorf("public key %q must be lowercase, store it as %s", public, canonical)
+	}
+	// The error of ParseKey would repeat the private key
+	privateKey, err := ParseKey(private)
+	if err != nil {
+		return fmt.Errorf("private key of %s is not 64 hex characters", public)
+	}
+
+	var derived [32]byte
+	curve25519.ScalarBaseMult(&derived, &privateKey)
+	if derived != publicKey {
+		return fmt.Errorf("private key does not belong to public key %s", public)
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/logical"
 )
@@ -16,7 +17,7 @@ func EJSON_Keys_Setup(t *testing.T, b logical.Backend, storage logical.Storage)
 			"private": "37124bcf00c2d9fd87ddd596162d99c004460fd47130f2d653e45f85a0681cf0",
 		},
 		{
-			"public":  "65f9592efefdf0e98df1c9e9b0742ff974705db8921e8a2da5810623f2c83851",
+			"public":  "f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f",
 			"private": "0fc1860a58f54e356d2f03174df064400c99d261695ddd78df9d2c00fcb42173",
 		},
 	}
@@ -45,11 +46,25 @@ func TestEJSON_Keys_Data_Put(t *testing.T) {
 func TestEJSON_Keys_Data_Get(t *testing.T) {
 	b, storage := getTestBackend(t)
 
-	EJSON_Keys_Setup(t, b, storage)
-
 	dataInput := map[string]interface{}{
-		"public":  "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
-		"private": "37124bcf00c2d9fd87ddd596162d99c004460fd47130f2d653e45f85a0681cf0",
+		"public":     "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		"private":    "37124bcf00c2d9fd87ddd596162d99c004460fd47130f2d653e45f85a0681cf0",
+		"exportable": true,
+	}
+
+	reqKP := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "keys/15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		Storage:   storage,
+		Data:      dataInput,
+	}
+
+	respKP, err := b.HandleRequest(context.Background(), reqKP)
+	if err != nil || (respKP != nil && respKP.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respKP)
+	}
+	if _, ok := respKP.Data["private"]; ok {
+		t.Fatalf("private key echoed in write response: %#v", respKP.Data)
 	}
 
 	reqRead := &logical.Request{
@@ -68,6 +83,71 @@ func TestEJSON_Keys_Data_Get(t *testing.T) {
 	}
 }
 
+func TestEJSON_Keys_Data_Get_NotExportable(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	reqKP := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "keypair",
+		Storage:   storage,
+	}
+
+	respKP, err := b.HandleRequest(context.Background(), reqKP)
+	if err != nil || (respKP != nil && respKP.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respKP)
+	}
+
+	for _, public := range []string{"15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56", respKP.Data["public"].(string)} {
+		reqRead := &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      fmt.Sprintf("keys/%s", public),
+			Storage:   storage,
+		}
+
+		respRead, err := b.HandleRequest(context.Background(), reqRead)
+		if err != nil || (respRead != nil && respRead.IsError()) {
+			t.Fatalf("err:%s resp:%#v\n", err, respRead)
+		}
+
+		if _, ok := respRead.Data["private"]; ok {
+			t.Fatalf("private key of %s returned although not exportable", public)
+		}
+		if respRead.Data["exportable"] != false {
+			t.Fatalf("Bad exportable flag: \nGot: %#v\nWant: %#v", respRead.Data["exportable"], false)
+		}
+	}
+}
+
+func TestEJSON_Keys_Data_Get_Legacy(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	// Key pairs stored before keys had settings only hold the private key
+	if err := storage.Put(context.Background(), &logical.StorageEntry{
+		Key:   "keys/15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		Value: []byte("37124bcf00c2d9fd87ddd596162d99c004460fd47130f2d653e45f85a0681cf0"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "keys/15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		Storage:   storage,
+	}
+
+	respRead, err := b.HandleRequest(context.Background(), reqRead)
+	if err != nil || (respRead != nil && respRead.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRead)
+	}
+	if respRead.Data["private"] != "37124bcf00c2d9fd87ddd596162d99c004460fd47130f2d653e45f85a0681cf0" {
+		t.Fatalf("Bad legacy key response: %#v", respRead.Data)
+	}
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+}
+
 func TestEJSON_Keys_Data_Delete(t *testing.T) {
 	b, storage := getTestBackend(t)
 
@@ -97,7 +177,7 @@ func TestEJSON_Keys_Data_List(t *testing.T) {
 
 	dataList := []string{
 		"15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
-		"65f9592efefdf0e98df1c9e9b0742ff974705db8921e8a2da5810623f2c83851",
+		"f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f",
 	}
 
 	if !reflect.DeepEqual(respList, dataList) {
@@ -150,3 +230,660 @@ func TestEJSON_KeyPairCreate(t *testing.T) {
 		t.Fatalf("write /keypair Did not add one new key to keys/")
 	}
 }
+
+func TestEJSON_Keys_Data_Put_Invalid(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	dataInputs := []map[string]interface{}{
+		// The private key belongs to f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f
+		{
+			"public":  "65f9592efefdf0e98df1c9e9b0742ff974705db8921e8a2da5810623f2c83851",
+			"private": "0fc1860a58f54e356d2f03174df064400c99d261695ddd78df9d2c00fcb42173",
+		},
+		{
+			"public":  "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+			"private": "37124bcf00c2d9fd87ddd596162d99c004460fd47130f2d653e45f85a0681cfz",
+		},
+		{
+			"public":  "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+			"private": "37124bcf00c2d9fd87ddd596162d99c004460fd47130f2d653e45f85a0681c",
+		},
+		{
+			"public":  "15838c2f",
+			"private": "37124bcf00c2d9fd87ddd596162d99c004460fd47130f2d653e45f85a0681cf0",
+		},
+		// Documents would look the key up in lowercase
+		{
+			"public":  "15838C2F3260185AD2A8E1298BD507479FF2470B9E9C1FD89E0FDFEFE2959F56",
+			"private": "37124bcf00c2d9fd87ddd596162d99c004460fd47130f2d653e45f85a0681cf0",
+		},
+	}
+
+	for _, dataInput := range dataInputs {
+		reqKP := &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      fmt.Sprintf("keys/%s", dataInput["public"]),
+			Storage:   storage,
+			Data:      dataInput,
+		}
+
+		respKP, err := b.HandleRequest(context.Background(), reqKP)
+		if err == nil {
+			t.Fatalf("expected invalid key pair to be rejected, resp:%#v", respKP)
+		}
+	}
+
+	keys, err := storage.List(context.Background(), "keys/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("invalid key pairs stored: %#v", keys)
+	}
+}
+
+func TestEJSON_Keys_Metadata(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	reqWrite := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "keys/15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56/metadata",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"name":        "payments-production",
+			"description": "Secrets of the payments service",
+			"owner":       "payments",
+		},
+	}
+
+	respWrite, err := b.HandleRequest(context.Background(), reqWrite)
+	if err != nil || (respWrite != nil && respWrite.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respWrite)
+	}
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+
+	// Storing the key pair again keeps its metadata
+	reqKP := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "keys/15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"private":    "37124bcf00c2d9fd87ddd596162d99c004460fd47130f2d653e45f85a0681cf0",
+			"exportable": true,
+		},
+	}
+
+	respKP, err := b.HandleRequest(context.Background(), reqKP)
+	if err != nil || (respKP != nil && respKP.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respKP)
+	}
+
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "keys/15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56/metadata",
+		Storage:   storage,
+	}
+
+	respRead, err := b.HandleRequest(context.Background(), reqRead)
+	if err != nil || (respRead != nil && respRead.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRead)
+	}
+
+	for field, want := range map[string]interface{}{
+		"name":          "payments-production",
+		"description":   "Secrets of the payments service",
+		"owner":         "payments",
+		"exportable":    true,
+		"decrypt_count": int64(1),
+	} {
+		if respRead.Data[field] != want {
+			t.Fatalf("Bad %s: \nGot: %#v\nWant: %#v", field, respRead.Data[field], want)
+		}
+	}
+	if respRead.Data["created_time"].(time.Time).IsZero() {
+		t.Fatalf("created_time not set: %#v", respRead.Data)
+	}
+	if respRead.Data["last_used_time"].(time.Time).IsZero() {
+		t.Fatalf("last_used_time not set: %#v", respRead.Data)
+	}
+
+	reqRead.Path = "keys/a5c0b19e7a8b2b7e0b0c0e3b47a6f2bde8f4d3b2f1e0c9d8b7a6f5e4d3c2b1a0/metadata"
+	respRead, err = b.HandleRequest(context.Background(), reqRead)
+	if err != nil || respRead != nil {
+		t.Fatalf("expected no metadata for unknown key, err:%s resp:%#v\n", err, respRead)
+	}
+}
+
+func TestEJSON_Keys_Metadata_UsageFlush(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+	EJSON_Document_Write(t, b, storage, "itsanothersecret", 1)
+
+	// The periodic function stores the counted decryptions
+	reqRollback := &logical.Request{
+		Operation: logical.RollbackOperation,
+		Path:      "",
+		Storage:   storage,
+	}
+	if _, err := b.HandleRequest(context.Background(), reqRollback); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := getKey(context.Background(), storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.DecryptCount != 2 {
+		t.Fatalf("Bad stored decrypt count: \nGot: %#v\nWant: %#v", key.DecryptCount, 2)
+	}
+	if key.LastUsedTime.IsZero() {
+		t.Fatalf("last used time not stored: %#v", key)
+	}
+}
+
+func TestEJSON_Keys_Metadata_Legacy(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	if err := storage.Put(context.Background(), &logical.StorageEntry{
+		Key:   "keys/15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		Value: []byte("37124bcf00c2d9fd87ddd596162d99c004460fd47130f2d653e45f85a0681cf0"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Storing the use of the key upgrades its entry
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+
+	reqRollback := &logical.Request{
+		Operation: logical.RollbackOperation,
+		Path:      "",
+		Storage:   storage,
+	}
+	if _, err := b.HandleRequest(context.Background(), reqRollback); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := storage.Get(context.Background(), "keys/15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &keyEntry{}
+	if err := entry.DecodeJSON(key); err != nil {
+		t.Fatalf("legacy key not migrated: %s", entry.Value)
+	}
+
+	// The creation time of the key pair is unknown, so it is due for
+	// scheduled rotation
+	dataKey := &keyEntry{
+		Private:      "37124bcf00c2d9fd87ddd596162d99c004460fd47130f2d653e45f85a0681cf0",
+		Exportable:   true,
+		LastUsedTime: key.LastUsedTime,
+		DecryptCount: 1,
+	}
+	if key.LastUsedTime.IsZero() || !reflect.DeepEqual(key, dataKey) {
+		t.Fatalf("Bad migrated key: \nGot: %#v\nWant: %#v", key, dataKey)
+	}
+}
+
+func readKeyUsage(t *testing.T, b logical.Backend, storage logical.Storage, public string) map[string]interface{} {
+	reqUsage := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      fmt.Sprintf("keys/%s/usage", public),
+		Storage:   storage,
+	}
+
+	respUsage, err := b.HandleRequest(context.Background(), reqUsage)
+	if err != nil || (respUsage != nil && respUsage.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respUsage)
+	}
+	return respUsage.Data["documents"].(map[string]interface{})
+}
+
+func TestEJSON_Keys_Usage(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+	EJSON_Document_Write(t, b, storage, "team/itsanothersecret", 1)
+
+	// Re-encrypt the first document with the other key
+	reqEncrypt := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "encrypt",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"public_key": "f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f",
+			"path":       "itsasecret",
+			"ejson": map[string]interface{}{
+				"asecret": "ohai",
+			},
+		},
+	}
+
+	respEncrypt, err := b.HandleRequest(context.Background(), reqEncrypt)
+	if err != nil || (respEncrypt != nil && respEncrypt.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respEncrypt)
+	}
+
+	dataUsage := map[string]interface{}{
+		"itsasecret": map[string]interface{}{
+			"versions": []int{1},
+			"current":  false,
+			"deleted":  false,
+		},
+		"team/itsanothersecret": map[string]interface{}{
+			"versions": []int{1},
+			"current":  true,
+			"deleted":  false,
+		},
+	}
+	usage := readKeyUsage(t, b, storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56")
+	if !reflect.DeepEqual(usage, dataUsage) {
+		t.Fatalf("Bad key usage: \nGot: %#v\nWant: %#v", usage, dataUsage)
+	}
+
+	dataUsage = map[string]interface{}{
+		"itsasecret": map[string]interface{}{
+			"versions": []int{2},
+			"current":  true,
+			"deleted":  false,
+		},
+	}
+	usage = readKeyUsage(t, b, storage, "f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f")
+	if !reflect.DeepEqual(usage, dataUsage) {
+		t.Fatalf("Bad key usage: \nGot: %#v\nWant: %#v", usage, dataUsage)
+	}
+
+	// Destroyed documents no longer use any key
+	reqDestroy := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "itsasecret/destroy",
+		Storage:   storage,
+	}
+
+	respDestroy, err := b.HandleRequest(context.Background(), reqDestroy)
+	if err != nil || (respDestroy != nil && respDestroy.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respDestroy)
+	}
+
+	usage = readKeyUsage(t, b, storage, "f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f")
+	if len(usage) != 0 {
+		t.Fatalf("Destroyed document still in use: %#v", usage)
+	}
+	keys, err := storage.List(context.Background(), "index/f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("Index entries left for destroyed document: %#v", keys)
+	}
+}
+
+func TestEJSON_Keys_Reindex(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "team/itsasecret", 1)
+
+	// Lose the entry of the document and leave a stale one behind
+	if err := storage.Delete(context.Background(), "index/15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56/team%2Fitsasecret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(context.Background(), &logical.StorageEntry{
+		Key: "index/f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f/team%2Fitsasecret",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if usage := readKeyUsage(t, b, storage, "f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f"); len(usage) != 0 {
+		t.Fatalf("Stale index entry reported: %#v", usage)
+	}
+
+	reqReindex := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "reindex",
+		Storage:   storage,
+	}
+
+	respReindex, err := b.HandleRequest(context.Background(), reqReindex)
+	if err != nil || (respReindex != nil && respReindex.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respReindex)
+	}
+
+	dataReindex := map[string]interface{}{
+		"added":   1,
+		"removed": 1,
+	}
+	if !reflect.DeepEqual(respReindex.Data, dataReindex) {
+		t.Fatalf("Bad reindex response: \nGot: %#v\nWant: %#v", respReindex.Data, dataReindex)
+	}
+
+	usage := readKeyUsage(t, b, storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56")
+	if _, ok := usage["team/itsasecret"]; !ok {
+		t.Fatalf("Document missing after reindex: %#v", usage)
+	}
+	keys, err := storage.List(context.Background(), "index/f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("Stale index entry not removed: %#v", keys)
+	}
+}
+
+func TestEJSON_Keys_Reindex_Initialize(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "team/itsasecret", 1)
+
+	// Mounts written by older versions have no index
+	if err := storage.Delete(context.Background(), "index/15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56/team%2Fitsasecret"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Initialize(context.Background(), &logical.InitializationRequest{Storage: storage}); err != nil {
+		t.Fatal(err)
+	}
+
+	usage := readKeyUsage(t, b, storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56")
+	if _, ok := usage["team/itsasecret"]; !ok {
+		t.Fatalf("Document missing after initialization: %#v", usage)
+	}
+
+	reqDelete := &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "keys/15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		Storage:   storage,
+	}
+
+	respDelete, err := b.HandleRequest(context.Background(), reqDelete)
+	if err == nil {
+		t.Fatalf("expected deletion of key in use to be rejected, resp:%#v", respDelete)
+	}
+}
+
+func TestEJSON_Keys_Delete_InUse(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+
+	reqDelete := &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "keys/15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		Storage:   storage,
+	}
+
+	respDelete, err := b.HandleRequest(context.Background(), reqDelete)
+	if err == nil {
+		t.Fatalf("expected deletion of key in use to be rejected, resp:%#v", respDelete)
+	}
+
+	reqDelete.Data = map[string]interface{}{
+		"force": true,
+	}
+	respDelete, err = b.HandleRequest(context.Background(), reqDelete)
+	if err != nil || (respDelete != nil && respDelete.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respDelete)
+	}
+
+	key, err := getKey(context.Background(), storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56")
+	if err != nil || key != nil {
+		t.Fatalf("key not deleted, err:%s key:%#v\n", err, key)
+	}
+}
+
+func TestEJSON_Keys_Delete_NotAllowed(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	reqMetadata := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "keys/f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f/metadata",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"deletion_allowed": false,
+		},
+	}
+
+	respMetadata, err := b.HandleRequest(context.Background(), reqMetadata)
+	if err != nil || (respMetadata != nil && respMetadata.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respMetadata)
+	}
+
+	// force only skips the check for stored documents
+	reqDelete := &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "keys/f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"force": true,
+		},
+	}
+
+	respDelete, err := b.HandleRequest(context.Background(), reqDelete)
+	if err == nil {
+		t.Fatalf("expected deletion of protected key to be rejected, resp:%#v", respDelete)
+	}
+
+	reqMetadata.Data["deletion_allowed"] = true
+	respMetadata, err = b.HandleRequest(context.Background(), reqMetadata)
+	if err != nil || (respMetadata != nil && respMetadata.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respMetadata)
+	}
+
+	respDelete, err = b.HandleRequest(context.Background(), reqDelete)
+	if err != nil || (respDelete != nil && respDelete.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respDelete)
+	}
+}
+
+func setKeyState(t *testing.T, b logical.Backend, storage logical.Storage, public string, state string) {
+	reqMetadata := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("keys/%s/metadata", public),
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"state": state,
+		},
+	}
+
+	respMetadata, err := b.HandleRequest(context.Background(), reqMetadata)
+	if err != nil || (respMetadata != nil && respMetadata.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respMetadata)
+	}
+}
+
+func TestEJSON_Keys_State(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	setKeyState(t, b, storage, "f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f", "decrypt-only")
+
+	respList, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "keys/",
+		Storage:   storage,
+	})
+	if err != nil || (respList != nil && respList.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respList)
+	}
+	dataKeyInfo := map[string]interface{}{
+		"15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56": map[string]interface{}{
+			"name":  "",
+			"state": "active",
+		},
+		"f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f": map[string]interface{}{
+			"name":  "",
+			"state": "decrypt-only",
+		},
+	}
+	if !reflect.DeepEqual(respList.Data["key_info"], dataKeyInfo) {
+		t.Fatalf("Bad list response: \nGot: %#v\nWant: %#v", respList.Data["key_info"], dataKeyInfo)
+	}
+
+	// Decrypt-only keys are not a target for copies
+	reqCopy := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "copy",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"document":   `{"_public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56", "asecret": "EJ[1:sdseJpJ3BpP9PO5Qs8IB4urmmYil46edSTek8SjgVGA=:zl7mkBzL4g2d0PE3hPucmfbDjf3aDK7K:iryi3H7wRGWvUI8kjfWLtP3sFiw=]"}`,
+			"public_key": "f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f",
+		},
+	}
+
+	respCopy, err := b.HandleRequest(context.Background(), reqCopy)
+	if err == nil {
+		t.Fatalf("expected copy to decrypt-only key to be rejected, resp:%#v", respCopy)
+	}
+
+	// but still decrypt until archived
+	setKeyState(t, b, storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56", "decrypt-only")
+
+	reqDecrypt := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "decrypt",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"_public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+			"asecret":     "EJ[1:sdseJpJ3BpP9PO5Qs8IB4urmmYil46edSTek8SjgVGA=:zl7mkBzL4g2d0PE3hPucmfbDjf3aDK7K:iryi3H7wRGWvUI8kjfWLtP3sFiw=]",
+		},
+	}
+
+	respDecrypt, err := b.HandleRequest(context.Background(), reqDecrypt)
+	if err != nil || (respDecrypt != nil && respDecrypt.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respDecrypt)
+	}
+
+	setKeyState(t, b, storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56", "archived")
+
+	respDecrypt, err = b.HandleRequest(context.Background(), reqDecrypt)
+	if err == nil {
+		t.Fatalf("expected decryption with archived key to be rejected, resp:%#v", respDecrypt)
+	}
+
+	reqMetadata := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "keys/15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56/metadata",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"state": "retired",
+		},
+	}
+
+	respMetadata, err := b.HandleRequest(context.Background(), reqMetadata)
+	if err == nil {
+		t.Fatalf("expected invalid state to be rejected, resp:%#v", respMetadata)
+	}
+}
+
+func TestEJSON_Keys_Metadata_SecretSalt(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	reqSalt := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "keys/__secret_salt",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"private": "mysalt",
+		},
+	}
+
+	respSalt, err := b.HandleRequest(context.Background(), reqSalt)
+	if err != nil || (respSalt != nil && respSalt.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respSalt)
+	}
+
+	reqs := []*logical.Request{
+		{
+			Operation: logical.UpdateOperation,
+			Path:      "keys/__secret_salt/metadata",
+			Data: map[string]interface{}{
+				"name": "x",
+			},
+		},
+		{
+			Operation: logical.ReadOperation,
+			Path:      "keys/__secret_salt/metadata",
+		},
+		{
+			Operation: logical.ReadOperation,
+			Path:      "keys/__secret_salt/usage",
+		},
+		{
+			Operation: logical.UpdateOperation,
+			Path:      "keys/__secret_salt/rotate-documents",
+		},
+	}
+
+	for _, req := range reqs {
+		req.Storage = storage
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("%s of %s was not rejected: %#v", req.Operation, req.Path, resp)
+		}
+	}
+
+	entry, err := storage.Get(context.Background(), "keys/__secret_salt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || string(entry.Value) != "mysalt" {
+		t.Fatalf("salt changed: %#v", entry)
+	}
+}
+
+func TestEJSON_Keys_State_LazyDecryption(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	reqConfig := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"decryption_mode": "lazy",
+		},
+	}
+
+	respConfig, err := b.HandleRequest(context.Background(), reqConfig)
+	if err != nil || (respConfig != nil && respConfig.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respConfig)
+	}
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "itsasecret/decrypted",
+		Storage:   storage,
+	}
+
+	// Cache the plaintext
+	respRead, err := b.HandleRequest(context.Background(), reqRead)
+	if err != nil || (respRead != nil && respRead.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRead)
+	}
+
+	setKeyState(t, b, storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56", "archived")
+
+	respRead, err = b.HandleRequest(context.Background(), reqRead)
+	if err == nil && (respRead == nil || !respRead.IsError()) {
+		t.Fatalf("expected read with archived key to be rejected, resp:%#v", respRead)
+	}
+}
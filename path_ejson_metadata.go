@@ -0,0 +1,129 @@
+package secretsejson
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func ejsonMetadataPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: documentPattern(".+", "/metadata"),
+			Fields: map[string]*framework.FieldSchema{
+				"path": {
+					Type:        framework.TypeString,
+					Description: "Path of the stored document",
+				},
+				"description": {
+					Type:        framework.TypeString,
+					Description: "Description of the stored document",
+				},
+				"labels": {
+					Type:        framework.TypeKVPairs,
+					Description: "Labels of the stored document, replacing all existing labels",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.metadataRead,
+				logical.CreateOperation: b.metadataWrite,
+				logical.UpdateOperation: b.metadataWrite,
+			},
+		},
+	}
+}
+
+func (b *backend) metadataRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("path").(string)
+	if resp, err := b.checkDocumentPath(req, name); resp != nil || err != nil {
+		return resp, err
+	}
+	path := documentKey(name)
+
+	meta, err := getDocumentMetadata(ctx, req.Storage, path)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return logical.ErrorResponse(fmt.Sprintf("failed to find metadata of %s", name)), nil
+	}
+
+	nextRotation := time.Time{}
+	if !meta.deleted() {
+		nextRotation, err = b.nextRotationTime(ctx, req.Storage, name, meta.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	versions := map[string]interface{}{}
+	for version, v := range meta.Versions {
+		versions[strconv.Itoa(version)] = map[string]interface{}{
+			"created_time": v.CreatedTime,
+			"created_by":   v.CreatedBy.toMap(),
+			"public_key":   v.PublicKey,
+			"rotated_from": v.RotatedFrom,
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"current_version":    meta.CurrentVersion,
+			"oldest_version":     meta.OldestVersion,
+			"version_count":      len(meta.Versions),
+			"created_time":       meta.CreatedTime,
+			"created_by":         meta.CreatedBy.toMap(),
+			"updated_time":       meta.UpdatedTime,
+			"updated_by":         meta.UpdatedBy.toMap(),
+			"public_key":         meta.PublicKey,
+			"description":        meta.Description,
+			"labels":             meta.Labels,
+			"versions":           versions,
+			"deleted_time":       meta.DeletedTime,
+			"deleted_by":         meta.DeletedBy.toMap(),
+			"next_rotation_time": nextRotation,
+		},
+	}, nil
+}
+
+func (b *backend) metadataWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("path").(string)
+	if resp, err := b.checkDocumentPath(req, name); resp != nil || err != nil {
+		return resp, err
+	}
+	path := documentKey(name)
+
+	unlock := b.lockDocument(path)
+	defer unlock()
+
+	entry, err := req.Storage.Get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return logical.ErrorResponse(fmt.Sprintf("failed to find document at %s", name)), nil
+	}
+
+	meta, err := b.loadDocumentMetadata(ctx, req.Storage, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if description, ok := data.GetOk("description"); ok {
+		meta.Description = description.(string)
+	}
+	if labels, ok := data.GetOk("labels"); ok {
+		meta.Labels = labels.(map[string]string)
+	}
+
+	b.Logger().Info("storing metadata of document", "path", name)
+	if err := putDocumentMetadata(ctx, req.Storage, path, meta); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,128 @@
+package secretsejson
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestEJSON_Metadata_Read(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+	EJSON_Document_Write(t, b, storage, "itsasecret", 2)
+
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "itsasecret/metadata",
+		Storage:   storage,
+	}
+
+	respRead, err := b.HandleRequest(context.Background(), reqRead)
+	if err != nil || (respRead != nil && respRead.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRead)
+	}
+
+	if respRead.Data["version_count"] != 2 {
+		t.Fatalf("Bad version count: \nGot: %#v\nWant: %#v", respRead.Data["version_count"], 2)
+	}
+	if respRead.Data["public_key"] != "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56" {
+		t.Fatalf("Bad public key: %#v", respRead.Data["public_key"])
+	}
+}
+
+func TestEJSON_Metadata_Write(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	reqWrite := &logical.Request{
+		Operation:   logical.UpdateOperation,
+		Path:        "itsasecret",
+		Storage:     storage,
+		EntityID:    "7d2e3179-f69b-450c-7179-ac8ee8bd8ca9",
+		DisplayName: "token-deployer",
+		Data: map[string]interface{}{
+			"ejson": map[string]interface{}{
+				"_public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+				"asecret":     "EJ[1:sdseJpJ3BpP9PO5Qs8IB4urmmYil46edSTek8SjgVGA=:zl7mkBzL4g2d0PE3hPucmfbDjf3aDK7K:iryi3H7wRGWvUI8kjfWLtP3sFiw=]",
+			},
+		},
+	}
+
+	respWrite, err := b.HandleRequest(context.Background(), reqWrite)
+	if err != nil || (respWrite != nil && respWrite.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respWrite)
+	}
+
+	reqMeta := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "itsasecret/metadata",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"description": "payments production secrets",
+			"labels": map[string]interface{}{
+				"team": "payments",
+			},
+		},
+	}
+
+	respMeta, err := b.HandleRequest(context.Background(), reqMeta)
+	if err != nil || (respMeta != nil && respMeta.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respMeta)
+	}
+
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "itsasecret/metadata",
+		Storage:   storage,
+	}
+
+	respRead, err := b.HandleRequest(context.Background(), reqRead)
+	if err != nil || (respRead != nil && respRead.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRead)
+	}
+
+	if respRead.Data["description"] != "payments production secrets" {
+		t.Fatalf("Bad description: %#v", respRead.Data["description"])
+	}
+	labels := map[string]string{"team": "payments"}
+	if !reflect.DeepEqual(respRead.Data["labels"], labels) {
+		t.Fatalf("Bad labels: \nGot: %#v\nWant: %#v", respRead.Data["labels"], labels)
+	}
+	createdBy := map[string]interface{}{
+		"entity_id":    "7d2e3179-f69b-450c-7179-ac8ee8bd8ca9",
+		"display_name": "token-deployer",
+	}
+	if !reflect.DeepEqual(respRead.Data["created_by"], createdBy) {
+		t.Fatalf("Bad writer: \nGot: %#v\nWant: %#v", respRead.Data["created_by"], createdBy)
+	}
+	if respRead.Data["current_version"] != 1 {
+		t.Fatalf("metadata update created a new version: %#v", respRead.Data["current_version"])
+	}
+}
+
+func TestEJSON_Metadata_Write_Missing(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	reqMeta := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "missing/metadata",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"description": "nothing here",
+		},
+	}
+
+	respMeta, err := b.HandleRequest(context.Background(), reqMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if respMeta == nil || !respMeta.IsError() {
+		t.Fatalf("expected metadata of a missing document to be rejected, resp:%#v", respMeta)
+	}
+}
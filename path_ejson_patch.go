@@ -0,0 +1,142 @@
+package secretsejson
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func ejsonPatchPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: documentPattern(".+", "/patch"),
+			Fields: map[string]*framework.FieldSchema{
+				"path": {
+					Type:        framework.TypeString,
+					Description: "Path of the stored document",
+				},
+				"ejson": {
+					Type:        framework.TypeMap,
+					Description: "JSON merge patch with plaintext values to set, null removes a key",
+				},
+				"cas": {
+					Type:        framework.TypeInt,
+					Description: "Current version of the document, the patch is rejected if it does not match",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.UpdateOperation: b.ejsonPatch,
+			},
+		},
+	}
+}
+
+// ejsonPatch applies a JSON merge patch to the stored document and encrypts
+// the new values with the document's own public key. Values the patch does not
+// touch keep their existing ciphertext.
+func (b *backend) ejsonPatch(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("path").(string)
+	if resp, err := b.checkDocumentPath(req, name); resp != nil || err != nil {
+		return resp, err
+	}
+	path := documentKey(name)
+
+	patch, ok := data.GetOk("ejson")
+	if !ok {
+		return logical.ErrorResponse("no patch provided"), logical.ErrInvalidRequest
+	}
+	if _, ok := patch.(map[string]interface{})["_public_key"]; ok {
+		return logical.ErrorResponse("the _public_key of a document cannot be patched"), logical.ErrInvalidRequest
+	}
+
+	unlock := b.lockDocument(path)
+	defer unlock()
+
+	if resp, err := b.checkAndSet(ctx, req, data, path); resp != nil || err != nil {
+		return resp, err
+	}
+
+	entry, err := req.Storage.Get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return logical.ErrorResponse(fmt.Sprintf("failed to find document at %s", name)), nil
+	}
+
+	// New values are encrypted with the key of the document, which must
+	// still be active
+	public, err := documentPublicKey(entry.Value)
+	if err != nil {
+		return nil, err
+	}
+	if resp, err := checkPublicKey(ctx, req.Storage, public); resp != nil || err != nil {
+		return resp, err
+	}
+
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(entry.Value, &doc); err != nil {
+		return nil, errwrap.Wrapf("failed to decode stored document: {{err}}", err)
+	}
+	doc = mergePatch(doc, patch).(map[string]interface{})
+
+	decData, err := MarshalForEjson(doc)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to marshall json: {{err}}", err)
+	}
+	// ejson leaves values that are already encrypted as they are
+	encData, err := EncryptEjson(ctx, decData)
+	if err != nil {
+		return nil, err
+	}
+
+	sanData, err := b.sanitizedPlaintext(ctx, req.Storage, encData)
+	if err != nil {
+		return nil, err
+	}
+
+	b.Logger().Info("patching document", "path", name)
+	meta, err := b.storeDocument(ctx, req, path, encData, sanData, "")
+	if err != nil {
+		return nil, err
+	}
+
+	encDoc := map[string]interface{}{}
+	if err := json.Unmarshal(encData, &encDoc); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"ejson":   encDoc,
+			"version": meta.CurrentVersion,
+		},
+	}, nil
+}
+
+// mergePatch applies a RFC 7396 JSON merge patch to doc and returns the
+// result. Objects are merged key by key, a null value removes the key and any
+// other value replaces what was there.
+func mergePatch(doc interface{}, patch interface{}) interface{} {
+	patchMap, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	docMap, ok := doc.(map[string]interface{})
+	if !ok {
+		docMap = map[string]interface{}{}
+	}
+
+	for k, v := range patchMap {
+		if v == nil {
+			delete(docMap, k)
+			continue
+		}
+		docMap[k] = mergePatch(docMap[k], v)
+	}
+	return docMap
+}
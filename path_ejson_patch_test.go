@@ -0,0 +1,156 @@
+package secretsejson
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestEJSON_Patch(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	respWrite := EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+	asecret := respWrite.Data["ejson"].(map[string]interface{})["asecret"]
+
+	reqPatch := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "itsasecret/patch",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"ejson": map[string]interface{}{
+				"bsecret": "yarly",
+				"anumber": nil,
+				"database": map[string]interface{}{
+					"password": "sicher",
+				},
+			},
+			"cas": 1,
+		},
+	}
+
+	respPatch, err := b.HandleRequest(context.Background(), reqPatch)
+	if err != nil || (respPatch != nil && respPatch.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respPatch)
+	}
+
+	if respPatch.Data["version"] != 2 {
+		t.Fatalf("Bad version: \nGot: %#v\nWant: %#v", respPatch.Data["version"], 2)
+	}
+
+	encDoc := respPatch.Data["ejson"].(map[string]interface{})
+	if encDoc["asecret"] != asecret {
+		t.Fatalf("Untouched ciphertext changed: \nGot: %#v\nWant: %#v", encDoc["asecret"], asecret)
+	}
+	if !strings.HasPrefix(encDoc["bsecret"].(string), "EJ[") {
+		t.Fatalf("Patched value not encrypted: %#v", encDoc["bsecret"])
+	}
+
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "itsasecret/decrypted",
+		Storage:   storage,
+	}
+
+	respRead, err := b.HandleRequest(context.Background(), reqRead)
+	if err != nil || (respRead != nil && respRead.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRead)
+	}
+
+	dataDec := map[string]interface{}{
+		"asecret": "ohai",
+		"bsecret": "yarly",
+		"database": map[string]interface{}{
+			"password": "sicher",
+		},
+	}
+	if !reflect.DeepEqual(respRead.Data["ejson"], dataDec) {
+		t.Fatalf("Bad decryption response: \nGot: %#v\nWant: %#v", respRead.Data["ejson"], dataDec)
+	}
+
+	// The cas of the first version no longer matches
+	respPatch, err = b.HandleRequest(context.Background(), reqPatch)
+	if err == nil {
+		t.Fatalf("expected stale cas to be rejected, resp:%#v", respPatch)
+	}
+}
+
+func TestEJSON_Patch_Invalid(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+
+	reqPatch := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "itsasecret/patch",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"ejson": map[string]interface{}{
+				"_public_key": "f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f",
+			},
+		},
+	}
+
+	respPatch, err := b.HandleRequest(context.Background(), reqPatch)
+	if err == nil {
+		t.Fatalf("expected patch of _public_key to be rejected, resp:%#v", respPatch)
+	}
+
+	reqPatch = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "nosecret/patch",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"ejson": map[string]interface{}{
+				"asecret": "ohai",
+			},
+		},
+	}
+
+	respPatch, err = b.HandleRequest(context.Background(), reqPatch)
+	if err != nil {
+		t.Fatalf("err:%s resp:%#v\n", err, respPatch)
+	}
+	if respPatch == nil || !respPatch.IsError() {
+		t.Fatalf("Patched a document that does not exist: \n%#v", respPatch)
+	}
+}
+
+func TestEJSON_Patch_DecryptOnlyKey(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+	setKeyState(t, b, storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56", "decrypt-only")
+
+	reqPatch := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "itsasecret/patch",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"ejson": map[string]interface{}{
+				"bsecret": "yarly",
+			},
+		},
+	}
+
+	respPatch, err := b.HandleRequest(context.Background(), reqPatch)
+	if err == nil && (respPatch == nil || !respPatch.IsError()) {
+		t.Fatalf("expected patch with decrypt-only key to be rejected, resp:%#v", respPatch)
+	}
+
+	version, err := currentVersion(context.Background(), storage, "docs/itsasecret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Fatalf("Bad version: \nGot: %#v\nWant: %#v", version, 1)
+	}
+}
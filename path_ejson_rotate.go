@@ -3,15 +3,37 @@ package secretsejson
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 
-	"github.com/Shopify/ejson"
 	ej "github.com/Shopify/ejson/json"
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
+// unprefixedName matches any document name but "docs", so that docs/rotate
+// addresses the document named rotate rather than rotating the document named
+// docs, which is still reachable as docs/docs/rotate.
+const unprefixedName = "(?:[^d].*|d[^o].*|do[^c].*|doc[^s].*|docs.+|d|do|doc)"
+
 func ejsonRotatePaths(b *backend) []*framework.Path {
+	documentFields := map[string]*framework.FieldSchema{
+		"path": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "Path of the stored document",
+		},
+		"public_key": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "Active public key stored in keys/ to rotate to, a new key pair is generated if not set",
+		},
+		"cas": &framework.FieldSchema{
+			Type:        framework.TypeInt,
+			Description: "Current version of the document, the rotation is rejected if it does not match",
+		},
+	}
+
 	return []*framework.Path{
 		&framework.Path{
 			Pattern: "rotate",
@@ -20,12 +42,34 @@ func ejsonRotatePaths(b *backend) []*framework.Path {
 					Type:        framework.TypeString,
 					Description: "EJSON Document",
 				},
+				"public_key": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Active public key stored in keys/ to rotate to, a new key pair is generated if not set",
+				},
+				"dry_run": &framework.FieldSchema{
+					Type:        framework.TypeBool,
+					Description: "Only report the fields that would change, without generating a key pair",
+				},
 			},
 			Callbacks: map[logical.Operation]framework.OperationFunc{
 				logical.CreateOperation: b.rotate,
 				logical.UpdateOperation: b.rotate,
 			},
 		},
+		&framework.Path{
+			Pattern: documentPrefix + "(?P<path>.+)/rotate",
+			Fields:  documentFields,
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.UpdateOperation: b.rotateDocument,
+			},
+		},
+		&framework.Path{
+			Pattern: "(?P<path>" + unprefixedName + ")/rotate",
+			Fields:  documentFields,
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.UpdateOperation: b.rotateDocument,
+			},
+		},
 	}
 }
 
@@ -35,6 +79,9 @@ func (b *backend) rotate(ctx context.Context, req *logical.Request, data *framew
 		if len(data.Raw) == 0 {
 			return logical.ErrorResponse("no data provided"), logical.ErrInvalidRequest
 		}
+		if resp, err := checkRawParameters(data.Raw, "public_key", "dry_run"); resp != nil || err != nil {
+			return resp, err
+		}
 		inputData = data.Raw
 	}
 
@@ -42,26 +89,46 @@ func (b *backend) rotate(ctx context.Context, req *logical.Request, data *framew
 	if err != nil {
 		return nil, errwrap.Wrapf("failed to marshal json: {{err}}", err)
 	}
-
-	decDoc, err := DecryptEjsonDocument(ctx, req, encData)
+	previous, err := documentPublicKey(encData)
 	if err != nil {
-		return nil, errwrap.Wrapf("failed to decrypt ejson: {{err}}", err)
+		return nil, err
 	}
 
-	public, private, err := ejson.GenerateKeypair()
+	// Without a public key a new key pair is generated
+	public := data.Get("public_key").(string)
+	if public != "" {
+		if resp, err := checkPublicKey(ctx, req.Storage, public); resp != nil || err != nil {
+			return resp, err
+		}
+		if public == previous {
+			return logical.ErrorResponse(fmt.Sprintf("document is already encrypted with %s", previous)), logical.ErrInvalidRequest
+		}
+	}
+
+	decDoc, err := b.decryptEjsonDocument(ctx, req, encData)
 	if err != nil {
-		return nil, errwrap.Wrapf("failed to generate keypair ejson: {{err}}", err)
+		return nil, errwrap.Wrapf("failed to decrypt ejson: {{err}}", err)
 	}
 
-	path := fmt.Sprintf("keys/%s", public)
-	b.Logger().Info(fmt.Sprintf("New key pair at %s", path))
-	entry := &logical.StorageEntry{
-		Key:   path,
-		Value: []byte(private),
+	if data.Get("dry_run").(bool) {
+		fields := []string{"/" + ej.PublicKeyField}
+		encryptedFields(decDoc, "", false, &fields)
+		sort.Strings(fields)
+
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"public_key":   public,
+				"rotated_from": previous,
+				"fields":       fields,
+			},
+		}, nil
 	}
 
-	if err := req.Storage.Put(ctx, entry); err != nil {
-		return nil, err
+	if public == "" {
+		public, err = b.generateKeyPair(ctx, req.Storage, &keyEntry{})
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	decDoc[ej.PublicKeyField] = public
@@ -77,3 +144,119 @@ func (b *backend) rotate(ctx context.Context, req *logical.Request, data *framew
 		},
 	}, nil
 }
+
+// encryptedFields adds the JSON pointer of every value ejson encrypts in value
+// to fields, as their ciphertext changes with the key.
+func encryptedFields(value interface{}, pointer string, underscored bool, fields *[]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			encryptedFields(child, pointer+"/"+pointerToken(k), strings.HasPrefix(k, "_"), fields)
+		}
+	case []interface{}:
+		for i, child := range v {
+			encryptedFields(child, pointer+"/"+strconv.Itoa(i), underscored, fields)
+		}
+	case string:
+		if !underscored {
+			*fields = append(*fields, pointer)
+		}
+	}
+}
+
+// rotateDocument re-encrypts the stored document with a new or given key pair
+// and stores it as a new version, so its plaintext never leaves Vault.
+func (b *backend) rotateDocument(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("path").(string)
+	if resp, err := b.checkDocumentPath(req, name); resp != nil || err != nil {
+		return resp, err
+	}
+	path := documentKey(name)
+
+	// Without a public key a new key pair is generated
+	public := data.Get("public_key").(string)
+	if public != "" {
+		if resp, err := checkPublicKey(ctx, req.Storage, public); resp != nil || err != nil {
+			return resp, err
+		}
+	}
+
+	unlock := b.lockDocument(path)
+	defer unlock()
+
+	if resp, err := b.checkAndSet(ctx, req, data, path); resp != nil || err != nil {
+		return resp, err
+	}
+
+	entry, err := req.Storage.Get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return logical.ErrorResponse(fmt.Sprintf("failed to find document at %s", name)), nil
+	}
+	previous, err := documentPublicKey(entry.Value)
+	if err != nil {
+		return nil, err
+	}
+	if public == previous {
+		return logical.ErrorResponse(fmt.Sprintf("document at %s is already encrypted with %s", name, previous)), logical.ErrInvalidRequest
+	}
+
+	encDoc, meta, rotatedTo, err := b.reencryptDocument(ctx, req, path, entry.Value, previous, public)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"ejson":        encDoc,
+			"version":      meta.CurrentVersion,
+			"public_key":   rotatedTo,
+			"rotated_from": previous,
+		},
+	}, nil
+}
+
+// reencryptDocument decrypts encData, the current ciphertext of the document
+// at path encrypted with previous, and stores it encrypted with public as a
+// new version. A new key pair is generated if public is empty. The caller
+// holds the lock of the document.
+func (b *backend) reencryptDocument(ctx context.Context, req *logical.Request, path string, encData []byte, previous string, public string) (map[string]interface{}, *documentMetadata, string, error) {
+	// The error already says that decryption failed, and ends up in the
+	// report of bulk rotations as is
+	decDoc, err := b.decryptEjsonDocument(ctx, req, encData)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	if public == "" {
+		public, err = b.generateKeyPair(ctx, req.Storage, &keyEntry{})
+		if err != nil {
+			return nil, nil, "", err
+		}
+	}
+	decDoc[ej.PublicKeyField] = public
+
+	encDoc, err := EncryptEjsonDocument(ctx, decDoc)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	encData, err = MarshalForEjson(encDoc)
+	if err != nil {
+		return nil, nil, "", errwrap.Wrapf("failed to marshall json: {{err}}", err)
+	}
+
+	sanData, err := b.sanitizedPlaintext(ctx, req.Storage, encData)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	b.Logger().Info("rotating document", "path", documentName(path), "from", previous, "to", public)
+	meta, err := b.storeDocument(ctx, req, path, encData, sanData, previous)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	return encDoc, meta, public, nil
+}
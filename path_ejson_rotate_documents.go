@@ -0,0 +1,573 @@
+package secretsejson
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// rotationPrefix holds the state of bulk rotations as
+// rotation/<public key rotated away from>.
+const rotationPrefix = "rotation/"
+
+const (
+	rotationStatusRunning   = "running"
+	rotationStatusCompleted = "completed"
+
+	rotationPending = "pending"
+	rotationRotated = "rotated"
+	rotationFailed  = "failed"
+	// rotationSkipped marks documents that were deleted or re-encrypted by
+	// someone else since the rotation started.
+	rotationSkipped = "skipped"
+)
+
+// rotationJob is the progress of re-encrypting every stored document using a
+// key, kept in storage so it can be resumed after a restart.
+type rotationJob struct {
+	PublicKey       string                     `json:"public_key"`
+	TargetPublicKey string                     `json:"target_public_key"`
+	Status          string                     `json:"status"`
+	StartedTime     time.Time                  `json:"started_time"`
+	StartedBy       *documentWriter            `json:"started_by"`
+	UpdatedTime     time.Time                  `json:"updated_time"`
+	CompletedTime   time.Time                  `json:"completed_time"`
+	Documents       map[string]*rotationResult `json:"documents"`
+
+	// DeprecateKey makes the key decrypt-only once the rotation completed and
+	// no current document uses it anymore
+	DeprecateKey bool `json:"deprecate_key"`
+}
+
+// rotationResult is the outcome of rotating a single document. Version is the
+// version written by the rotation, or the version that failed to re-encrypt.
+type rotationResult struct {
+	Status  string `json:"status"`
+	Version int    `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func ejsonRotateDocumentsPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "keys/(?P<public>[^/]+)/rotate-documents",
+			Fields: map[string]*framework.FieldSchema{
+				"public": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "EJSON Public key to rotate away from",
+				},
+				"public_key": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Active public key stored in keys/ to rotate to, a new key pair is generated if not set",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.rotateDocumentsRead,
+				logical.UpdateOperation: b.rotateDocumentsStart,
+			},
+		},
+	}
+}
+
+func rotationKey(public string) string {
+	return rotationPrefix + public
+}
+
+func getRotationJob(ctx context.Context, s logical.Storage, public string) (*rotationJob, error) {
+	entry, err := s.Get(ctx, rotationKey(public))
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	job := &rotationJob{}
+	if err := entry.DecodeJSON(job); err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("failed to decode rotation of %s: {{err}}", public), err)
+	}
+	return job, nil
+}
+
+func putRotationJob(ctx context.Context, s logical.Storage, job *rotationJob) error {
+	entry, err := logical.StorageEntryJSON(rotationKey(job.PublicKey), job)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+func (j *rotationJob) toResponse() *logical.Response {
+	counts := map[string]int{
+		rotationPending: 0,
+		rotationRotated: 0,
+		rotationFailed:  0,
+		rotationSkipped: 0,
+	}
+	documents := map[string]interface{}{}
+	for name, result := range j.Documents {
+		counts[result.Status]++
+		documents[name] = map[string]interface{}{
+			"status":  result.Status,
+			"version": result.Version,
+			"error":   result.Error,
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"public_key":        j.PublicKey,
+			"target_public_key": j.TargetPublicKey,
+			"status":            j.Status,
+			"started_time":      j.StartedTime,
+			"started_by":        j.StartedBy.toMap(),
+			"updated_time":      j.UpdatedTime,
+			"completed_time":    j.CompletedTime,
+			"deprecate_key":     j.DeprecateKey,
+			"counts":            counts,
+			"documents":         documents,
+		},
+	}
+}
+
+func (b *backend) rotateDocumentsRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	job, err := getRotationJob(ctx, req.Storage, data.Get("public").(string))
+	if err != nil || job == nil {
+		return nil, err
+	}
+	return job.toResponse(), nil
+}
+
+// rotateDocumentsStart starts re-encrypting the current version of every
+// stored document using the key in the background. Progress is read back from
+// the same path.
+func (b *backend) rotateDocumentsStart(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	public := data.Get("public").(string)
+	if resp, err := checkNotSecretSalt(public); resp != nil || err != nil {
+		return resp, err
+	}
+
+	key, err := getKey(ctx, req.Storage, public)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return logical.ErrorResponse(fmt.Sprintf("failed to find key in %s", keyPath(public))), logical.ErrInvalidRequest
+	}
+
+	// Without a public key a new key pair is generated
+	target := data.Get("public_key").(string)
+	if target != "" {
+		if resp, err := checkPublicKey(ctx, req.Storage, target); resp != nil || err != nil {
+			return resp, err
+		}
+		if target == public {
+			return logical.ErrorResponse("public_key must differ from the key to rotate away from"), logical.ErrInvalidRequest
+		}
+	}
+
+	unlock := b.lockDocument(rotationKey(public))
+	defer unlock()
+
+	job, err := getRotationJob(ctx, req.Storage, public)
+	if err != nil {
+		return nil, err
+	}
+	if job != nil && job.Status == rotationStatusRunning {
+		return logical.ErrorResponse(fmt.Sprintf("rotation of the documents using %s is already running", public)), logical.ErrInvalidRequest
+	}
+
+	// Soft deleted documents are left alone, rotating them would restore them
+	usage, err := b.keyUsageDocuments(ctx, req.Storage, public)
+	if err != nil {
+		return nil, err
+	}
+	documents := map[string]*rotationResult{}
+	for name, u := range usage {
+		u := u.(map[string]interface{})
+		if u["current"].(bool) && !u["deleted"].(bool) {
+			documents[name] = &rotationResult{Status: rotationPending}
+		}
+	}
+	if len(documents) == 0 {
+		return logical.ErrorResponse(fmt.Sprintf("no stored documents are encrypted with %s", public)), logical.ErrInvalidRequest
+	}
+
+	if target == "" {
+		target, err = b.generateKeyPair(ctx, req.Storage, &keyEntry{})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now().UTC()
+	job = &rotationJob{
+		PublicKey:       public,
+		TargetPublicKey: target,
+		Status:          rotationStatusRunning,
+		StartedTime:     now,
+		StartedBy:       writerFromRequest(req),
+		UpdatedTime:     now,
+		Documents:       documents,
+	}
+	if err := b.launchRotationJob(ctx, req.Storage, job); err != nil {
+		return nil, err
+	}
+
+	return job.toResponse(), nil
+}
+
+// launchRotationJob stores a new rotation and starts working on it. The caller
+// holds the lock of the rotation.
+func (b *backend) launchRotationJob(ctx context.Context, s logical.Storage, job *rotationJob) error {
+	if err := putRotationJob(ctx, s, job); err != nil {
+		return err
+	}
+
+	b.Logger().Info("starting rotation of documents", "from", job.PublicKey, "to", job.TargetPublicKey, "documents", len(job.Documents))
+	go b.runRotationJob(s, job.PublicKey)
+	return nil
+}
+
+// scheduleRotations starts a rotation for every key older than the rotation
+// period of a current document encrypted with it. The rotation only covers
+// the documents that are due, the key is deprecated once none are left.
+func (b *backend) scheduleRotations(ctx context.Context, s logical.Storage) error {
+	config, err := b.config(ctx, s)
+	if err != nil {
+		return err
+	}
+	minPeriod := config.minRotationPeriod()
+	if minPeriod <= 0 {
+		return nil
+	}
+
+	publics, err := s.List(ctx, "keys/")
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, public := range publics {
+		if public == secretSaltKey {
+			continue
+		}
+		key, err := getKey(ctx, s, public)
+		if err != nil {
+			return err
+		}
+		// Key pairs stored before their creation time was recorded count as
+		// old enough
+		if key == nil || !key.canDecrypt() || key.CreatedTime.Add(minPeriod).After(now) {
+			continue
+		}
+
+		if err := b.scheduleRotation(ctx, s, config, public, key, now); err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("failed to schedule rotation of %s: {{err}}", public), err)
+		}
+	}
+	return nil
+}
+
+func (b *backend) scheduleRotation(ctx context.Context, s logical.Storage, config *ejsonConfig, public string, key *keyEntry, now time.Time) error {
+	unlock := b.lockDocument(rotationKey(public))
+	defer unlock()
+
+	job, err := getRotationJob(ctx, s, public)
+	if err != nil {
+		return err
+	}
+	if job != nil && job.Status == rotationStatusRunning {
+		return nil
+	}
+
+	// Documents that failed the previous scheduled rotation are only retried
+	// once they changed, rather than on every periodic run
+	var previous *rotationJob
+	if job != nil && job.DeprecateKey {
+		previous = job
+	}
+
+	usage, err := b.keyUsageDocuments(ctx, s, public)
+	if err != nil {
+		return err
+	}
+	documents := map[string]*rotationResult{}
+	for name, u := range usage {
+		u := u.(map[string]interface{})
+		period := config.rotationPeriod(name)
+		if !u["current"].(bool) || u["deleted"].(bool) || period <= 0 || key.CreatedTime.Add(period).After(now) {
+			continue
+		}
+		if previous != nil {
+			failed, err := failedRotation(ctx, s, previous, name)
+			if err != nil {
+				return err
+			}
+			if failed {
+				continue
+			}
+		}
+		documents[name] = &rotationResult{Status: rotationPending}
+	}
+	if len(documents) == 0 {
+		return nil
+	}
+
+	target, err := b.scheduledRotationTarget(ctx, s, previous, key)
+	if err != nil {
+		return err
+	}
+
+	return b.launchRotationJob(ctx, s, &rotationJob{
+		PublicKey:       public,
+		TargetPublicKey: target,
+		Status:          rotationStatusRunning,
+		StartedTime:     now,
+		UpdatedTime:     now,
+		Documents:       documents,
+		DeprecateKey:    true,
+	})
+}
+
+// failedRotation reports whether the document name failed to rotate in job
+// and has not been written since.
+func failedRotation(ctx context.Context, s logical.Storage, job *rotationJob, name string) (bool, error) {
+	result, ok := job.Documents[name]
+	if !ok || result.Status != rotationFailed || result.Version == 0 {
+		return false, nil
+	}
+	version, err := currentVersion(ctx, s, documentKey(name))
+	if err != nil {
+		return false, err
+	}
+	return version == result.Version, nil
+}
+
+// scheduledRotationTarget returns the key pair the previous scheduled rotation
+// of key rotated to while it can still be used, so retries do not mint a new
+// key pair every time, and otherwise generates a key pair taking over the
+// description of key.
+func (b *backend) scheduledRotationTarget(ctx context.Context, s logical.Storage, previous *rotationJob, key *keyEntry) (string, error) {
+	if previous != nil && previous.TargetPublicKey != "" {
+		target, err := getKey(ctx, s, previous.TargetPublicKey)
+		if err != nil {
+			return "", err
+		}
+		if target != nil && target.canEncrypt() {
+			return previous.TargetPublicKey, nil
+		}
+	}
+
+	return b.generateKeyPair(ctx, s, &keyEntry{
+		Name:        key.Name,
+		Description: key.Description,
+		Owner:       key.Owner,
+	})
+}
+
+// nextRotationTime returns when the document name, encrypted with public, is
+// due for scheduled rotation, or the zero time if it is not scheduled.
+func (b *backend) nextRotationTime(ctx context.Context, s logical.Storage, name string, public string) (time.Time, error) {
+	config, err := b.config(ctx, s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	period := config.rotationPeriod(name)
+	if period <= 0 || public == "" {
+		return time.Time{}, nil
+	}
+
+	key, err := getKey(ctx, s, public)
+	if err != nil || key == nil || !key.canDecrypt() {
+		return time.Time{}, err
+	}
+	return key.CreatedTime.Add(period), nil
+}
+
+// deprecateKey makes the key of public decrypt-only unless a current document
+// is still encrypted with it.
+func (b *backend) deprecateKey(ctx context.Context, s logical.Storage, public string) error {
+	usage, err := b.keyUsageDocuments(ctx, s, public)
+	if err != nil {
+		return err
+	}
+	for _, u := range usage {
+		u := u.(map[string]interface{})
+		if u["current"].(bool) && !u["deleted"].(bool) {
+			return nil
+		}
+	}
+
+	unlock := b.lockDocument(keyPath(public))
+	defer unlock()
+
+	key, err := getKey(ctx, s, public)
+	if err != nil || key == nil || key.state() != keyStateActive {
+		return err
+	}
+	key.State = keyStateDecryptOnly
+
+	b.Logger().Info("deprecating rotated key", "public_key", public)
+	return putKey(ctx, s, public, key)
+}
+
+// resumeRotationJobs restarts the rotations left running when the backend was
+// last stopped.
+func (b *backend) resumeRotationJobs(ctx context.Context, s logical.Storage) error {
+	publics, err := s.List(ctx, rotationPrefix)
+	if err != nil {
+		return err
+	}
+
+	for _, public := range publics {
+		if strings.HasSuffix(public, "/") {
+			continue
+		}
+		job, err := getRotationJob(ctx, s, public)
+		if err != nil {
+			return err
+		}
+		if job != nil && job.Status == rotationStatusRunning {
+			go b.runRotationJob(s, public)
+		}
+	}
+	return nil
+}
+
+// runRotationJob works through the pending documents of the rotation away from
+// public. If it is already being worked on, the running worker is asked to
+// check the rotation once more, as a new one may have replaced it.
+func (b *backend) runRotationJob(s logical.Storage, public string) {
+	b.rotationJobsLock.Lock()
+	if _, ok := b.rotationJobs[public]; ok {
+		b.rotationJobs[public] = true
+		b.rotationJobsLock.Unlock()
+		return
+	}
+	b.rotationJobs[public] = false
+	b.rotationJobsLock.Unlock()
+
+	for {
+		err := b.rotateJobDocuments(b.jobsCtx, s, public)
+		if err != nil {
+			b.Logger().Error("rotation of documents interrupted, resuming on the next periodic run", "from", public, "error", err)
+		}
+
+		b.rotationJobsLock.Lock()
+		if b.rotationJobs[public] && err == nil {
+			b.rotationJobs[public] = false
+			b.rotationJobsLock.Unlock()
+			continue
+		}
+		delete(b.rotationJobs, public)
+		b.rotationJobsLock.Unlock()
+		return
+	}
+}
+
+func (b *backend) rotateJobDocuments(ctx context.Context, s logical.Storage, public string) error {
+	job, err := getRotationJob(ctx, s, public)
+	if err != nil || job == nil || job.Status != rotationStatusRunning {
+		return err
+	}
+
+	// Versions are recorded as written by whoever started the rotation
+	req := &logical.Request{
+		Storage: s,
+	}
+	if job.StartedBy != nil {
+		req.EntityID = job.StartedBy.EntityID
+		req.DisplayName = job.StartedBy.DisplayName
+	}
+
+	names := make([]string, 0, len(job.Documents))
+	for name := range job.Documents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if job.Documents[name].Status != rotationPending {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		job.Documents[name] = b.rotateJobDocument(ctx, req, name, public, job.TargetPublicKey)
+		job.UpdatedTime = time.Now().UTC()
+		if err := putRotationJob(ctx, s, job); err != nil {
+			return err
+		}
+	}
+
+	if job.DeprecateKey {
+		if err := b.deprecateKey(ctx, s, public); err != nil {
+			return err
+		}
+	}
+
+	job.Status = rotationStatusCompleted
+	job.CompletedTime = time.Now().UTC()
+	job.UpdatedTime = job.CompletedTime
+	b.Logger().Info("completed rotation of documents", "from", public, "to", job.TargetPublicKey)
+	return putRotationJob(ctx, s, job)
+}
+
+// rotateJobDocument re-encrypts a single document of a rotation. Failures are
+// recorded in the result rather than stopping the rotation.
+func (b *backend) rotateJobDocument(ctx context.Context, req *logical.Request, name string, public string, target string) *rotationResult {
+	path := documentKey(name)
+
+	unlock := b.lockDocument(path)
+	defer unlock()
+
+	entry, err := req.Storage.Get(ctx, path)
+	if err != nil {
+		return &rotationResult{Status: rotationFailed, Error: err.Error()}
+	}
+	if entry == nil {
+		return &rotationResult{Status: rotationSkipped, Error: "document no longer exists"}
+	}
+	previous, err := documentPublicKey(entry.Value)
+	if err != nil {
+		return &rotationResult{Status: rotationFailed, Error: err.Error()}
+	}
+	version, err := currentVersion(ctx, req.Storage, path)
+	if err != nil {
+		return &rotationResult{Status: rotationFailed, Error: err.Error()}
+	}
+	// A rotation interrupted before recording its result rotated the
+	// document already
+	if previous == target {
+		return &rotationResult{Status: rotationRotated, Version: version}
+	}
+	if previous != public {
+		return &rotationResult{Status: rotationSkipped, Error: fmt.Sprintf("document is encrypted with %s", previous)}
+	}
+
+	// The target may have been deprecated or archived since the rotation
+	// started. The document itself is fine, so no version is recorded and
+	// scheduled rotations retry it.
+	key, err := getKey(ctx, req.Storage, target)
+	if err != nil {
+		return &rotationResult{Status: rotationFailed, Error: err.Error()}
+	}
+	if key == nil {
+		return &rotationResult{Status: rotationFailed, Error: fmt.Sprintf("failed to find key in %s", keyPath(target))}
+	}
+	if !key.canEncrypt() {
+		return &rotationResult{Status: rotationFailed, Error: fmt.Sprintf("key %s is %s and cannot be used to encrypt", keyPath(target), key.state())}
+	}
+
+	_, meta, _, err := b.reencryptDocument(ctx, req, path, entry.Value, previous, target)
+	if err != nil {
+		b.Logger().Warn("failed to rotate document", "path", name, "error", err)
+		return &rotationResult{Status: rotationFailed, Version: version, Error: err.Error()}
+	}
+	return &rotationResult{Status: rotationRotated, Version: meta.CurrentVersion}
+}
@@ -0,0 +1,440 @@
+package secretsejson
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func waitForRotation(t *testing.T, b logical.Backend, storage logical.Storage, public string) *logical.Response {
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "keys/" + public + "/rotate-documents",
+		Storage:   storage,
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		respRead, err := b.HandleRequest(context.Background(), reqRead)
+		if err != nil || (respRead != nil && respRead.IsError()) {
+			t.Fatalf("err:%s resp:%#v\n", err, respRead)
+		}
+		if respRead != nil && respRead.Data["status"] == "completed" {
+			return respRead
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("rotation of %s did not complete", public)
+	return nil
+}
+
+func TestEJSON_RotateDocuments(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+	EJSON_Document_Write(t, b, storage, "team/itsasecret", 1)
+	EJSON_Document_Write(t, b, storage, "deletedsecret", 1)
+	EJSON_Document_Delete(t, b, storage, "deletedsecret")
+
+	reqStart := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "keys/15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56/rotate-documents",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"public_key": "f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f",
+		},
+	}
+
+	respStart, err := b.HandleRequest(context.Background(), reqStart)
+	if err != nil || (respStart != nil && respStart.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respStart)
+	}
+
+	respRead := waitForRotation(t, b, storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56")
+
+	counts := respRead.Data["counts"].(map[string]int)
+	if counts["rotated"] != 2 || counts["failed"] != 0 || counts["skipped"] != 0 {
+		t.Fatalf("Bad rotation counts: %#v", respRead.Data)
+	}
+
+	for _, name := range []string{"itsasecret", "team/itsasecret"} {
+		reqRead := &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      name,
+			Storage:   storage,
+		}
+
+		respDoc, err := b.HandleRequest(context.Background(), reqRead)
+		if err != nil || (respDoc != nil && respDoc.IsError()) {
+			t.Fatalf("err:%s resp:%#v\n", err, respDoc)
+		}
+		if respDoc.Data["ejson"].(map[string]interface{})["_public_key"] != "f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f" {
+			t.Fatalf("%s not rotated: %#v", name, respDoc.Data)
+		}
+
+		result := respRead.Data["documents"].(map[string]interface{})[name].(map[string]interface{})
+		if result["status"] != "rotated" || result["version"] != 2 {
+			t.Fatalf("Bad result for %s: %#v", name, result)
+		}
+	}
+
+	// The deleted document is left alone
+	if _, ok := respRead.Data["documents"].(map[string]interface{})["deletedsecret"]; ok {
+		t.Fatalf("Deleted document rotated: %#v", respRead.Data)
+	}
+
+	// Nothing left to rotate
+	respStart, err = b.HandleRequest(context.Background(), reqStart)
+	if err == nil {
+		t.Fatalf("expected rotation without documents to be rejected, resp:%#v", respStart)
+	}
+}
+
+func TestEJSON_RotateDocuments_Resume(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+	EJSON_Document_Write(t, b, storage, "team/itsasecret", 1)
+	EJSON_Document_Write(t, b, storage, "rotatedsecret", 1)
+
+	// The restart hit after rotating this document, before recording it
+	reqRotate := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "rotatedsecret/rotate",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"public_key": "f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f",
+		},
+	}
+	if respRotate, err := b.HandleRequest(context.Background(), reqRotate); err != nil || (respRotate != nil && respRotate.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRotate)
+	}
+
+	// A rotation interrupted by a restart, with one document done
+	job := &rotationJob{
+		PublicKey:       "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		TargetPublicKey: "f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f",
+		Status:          "running",
+		StartedTime:     time.Now().UTC(),
+		Documents: map[string]*rotationResult{
+			"itsasecret":      {Status: "pending"},
+			"team/itsasecret": {Status: "rotated", Version: 2},
+			"rotatedsecret":   {Status: "pending"},
+			"nosecret":        {Status: "pending"},
+		},
+	}
+	if err := putRotationJob(context.Background(), storage, job); err != nil {
+		t.Fatal(err)
+	}
+
+	reqStart := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "keys/15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56/rotate-documents",
+		Storage:   storage,
+	}
+
+	respStart, err := b.HandleRequest(context.Background(), reqStart)
+	if err == nil {
+		t.Fatalf("expected second rotation to be rejected, resp:%#v", respStart)
+	}
+
+	// The periodic function resumes it
+	reqRollback := &logical.Request{
+		Operation: logical.RollbackOperation,
+		Path:      "",
+		Storage:   storage,
+	}
+	if _, err := b.HandleRequest(context.Background(), reqRollback); err != nil {
+		t.Fatal(err)
+	}
+
+	respRead := waitForRotation(t, b, storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56")
+
+	documents := respRead.Data["documents"].(map[string]interface{})
+	for name, status := range map[string]string{
+		"itsasecret":      "rotated",
+		"team/itsasecret": "rotated",
+		"rotatedsecret":   "rotated",
+		"nosecret":        "skipped",
+	} {
+		if documents[name].(map[string]interface{})["status"] != status {
+			t.Fatalf("Bad result for %s: \nGot: %#v\nWant: %#v", name, documents[name], status)
+		}
+	}
+
+	if documents["rotatedsecret"].(map[string]interface{})["version"] != 2 {
+		t.Fatalf("Bad result for rotatedsecret: %#v", documents["rotatedsecret"])
+	}
+	counts := respRead.Data["counts"].(map[string]int)
+	if counts["rotated"] != 3 || counts["skipped"] != 1 {
+		t.Fatalf("Bad rotation counts: %#v", counts)
+	}
+
+	// Only the pending document was rotated again
+	for path, expected := range map[string]int{"docs/team/itsasecret": 1, "docs/rotatedsecret": 2} {
+		version, err := currentVersion(context.Background(), storage, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != expected {
+			t.Fatalf("Completed document %s rotated again: version %d", path, version)
+		}
+	}
+}
+
+func TestEJSON_RotateDocuments_TargetArchived(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+
+	// The target was archived while the rotation was interrupted
+	job := &rotationJob{
+		PublicKey:       "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		TargetPublicKey: "f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f",
+		Status:          "running",
+		StartedTime:     time.Now().UTC(),
+		Documents: map[string]*rotationResult{
+			"itsasecret": {Status: "pending"},
+		},
+	}
+	if err := putRotationJob(context.Background(), storage, job); err != nil {
+		t.Fatal(err)
+	}
+	setKeyState(t, b, storage, "f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f", "archived")
+
+	reqRollback := &logical.Request{
+		Operation: logical.RollbackOperation,
+		Path:      "",
+		Storage:   storage,
+	}
+	if _, err := b.HandleRequest(context.Background(), reqRollback); err != nil {
+		t.Fatal(err)
+	}
+
+	respRead := waitForRotation(t, b, storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56")
+
+	result := respRead.Data["documents"].(map[string]interface{})["itsasecret"].(map[string]interface{})
+	if result["status"] != "failed" || !strings.Contains(result["error"].(string), "archived") {
+		t.Fatalf("Bad result: %#v", result)
+	}
+
+	version, err := currentVersion(context.Background(), storage, "docs/itsasecret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Fatalf("Document rotated to an archived key: version %d", version)
+	}
+}
+
+func TestEJSON_RotateDocuments_Scheduled(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "payments/itsasecret", 1)
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+
+	// Age the key beyond the rotation period of payments/ only
+	key, err := getKey(context.Background(), storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.CreatedTime = time.Now().UTC().Add(-40 * 24 * time.Hour)
+	key.Name = "production"
+	if err := putKey(context.Background(), storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56", key); err != nil {
+		t.Fatal(err)
+	}
+
+	reqConfig := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"rotation_period": "90d",
+			"rotation_policies": map[string]interface{}{
+				"payments/": "30d",
+			},
+		},
+	}
+
+	respConfig, err := b.HandleRequest(context.Background(), reqConfig)
+	if err != nil || (respConfig != nil && respConfig.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respConfig)
+	}
+
+	reqMetadata := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "payments/itsasecret/metadata",
+		Storage:   storage,
+	}
+
+	respMetadata, err := b.HandleRequest(context.Background(), reqMetadata)
+	if err != nil || (respMetadata != nil && respMetadata.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respMetadata)
+	}
+	if want := key.CreatedTime.Add(30 * 24 * time.Hour); !respMetadata.Data["next_rotation_time"].(time.Time).Equal(want) {
+		t.Fatalf("Bad next_rotation_time: \nGot: %#v\nWant: %#v", respMetadata.Data["next_rotation_time"], want)
+	}
+
+	reqRollback := &logical.Request{
+		Operation: logical.RollbackOperation,
+		Path:      "",
+		Storage:   storage,
+	}
+	if _, err := b.HandleRequest(context.Background(), reqRollback); err != nil {
+		t.Fatal(err)
+	}
+
+	respRead := waitForRotation(t, b, storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56")
+	documents := respRead.Data["documents"].(map[string]interface{})
+	if len(documents) != 1 || documents["payments/itsasecret"] == nil {
+		t.Fatalf("Bad documents rotated: %#v", documents)
+	}
+
+	target := respRead.Data["target_public_key"].(string)
+	targetKey, err := getKey(context.Background(), storage, target)
+	if err != nil || targetKey == nil {
+		t.Fatalf("new key pair not stored, err:%s key:%#v\n", err, targetKey)
+	}
+	if targetKey.Name != "production" {
+		t.Fatalf("Bad name of new key pair: %#v", targetKey.Name)
+	}
+
+	// The key is still used by the document outside of payments/
+	key, err = getKey(context.Background(), storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.state() != "active" {
+		t.Fatalf("Key in use deprecated: %#v", key.state())
+	}
+
+	reqConfig.Data = map[string]interface{}{
+		"rotation_period": "30d",
+	}
+	respConfig, err = b.HandleRequest(context.Background(), reqConfig)
+	if err != nil || (respConfig != nil && respConfig.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respConfig)
+	}
+	if _, err := b.HandleRequest(context.Background(), reqRollback); err != nil {
+		t.Fatal(err)
+	}
+
+	respRead = waitForRotation(t, b, storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56")
+	documents = respRead.Data["documents"].(map[string]interface{})
+	if len(documents) != 1 || documents["itsasecret"] == nil {
+		t.Fatalf("Bad documents rotated: %#v", documents)
+	}
+
+	key, err = getKey(context.Background(), storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.state() != "decrypt-only" {
+		t.Fatalf("Rotated key not deprecated: %#v", key.state())
+	}
+}
+
+func TestEJSON_RotateDocuments_Scheduled_Failed(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+
+	key, err := getKey(context.Background(), storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.CreatedTime = time.Now().UTC().Add(-40 * 24 * time.Hour)
+	if err := putKey(context.Background(), storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56", key); err != nil {
+		t.Fatal(err)
+	}
+
+	// Break the ciphertext so the document cannot be decrypted anymore
+	corrupted := `{"_public_key":"15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56","asecret":"EJ[1:sdseJpJ3BpP9PO5Qs8IB4urmmYil46edSTek8SjgVGA=:zl7mkBzL4g2d0PE3hPucmfbDjf3aDK7K:AAAAAAAAAAAAAAAAAAAAAAAAAAA=]"}`
+	if err := storage.Put(context.Background(), &logical.StorageEntry{Key: "docs/itsasecret", Value: []byte(corrupted)}); err != nil {
+		t.Fatal(err)
+	}
+
+	reqConfig := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"rotation_period": "30d",
+		},
+	}
+
+	respConfig, err := b.HandleRequest(context.Background(), reqConfig)
+	if err != nil || (respConfig != nil && respConfig.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respConfig)
+	}
+
+	reqRollback := &logical.Request{
+		Operation: logical.RollbackOperation,
+		Path:      "",
+		Storage:   storage,
+	}
+	if _, err := b.HandleRequest(context.Background(), reqRollback); err != nil {
+		t.Fatal(err)
+	}
+
+	respRead := waitForRotation(t, b, storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56")
+	result := respRead.Data["documents"].(map[string]interface{})["itsasecret"].(map[string]interface{})
+	if result["status"] != "failed" || result["version"] != 1 {
+		t.Fatalf("Bad result: %#v", result)
+	}
+	if !strings.HasPrefix(result["error"].(string), "failed to decrypt ejson: ") || strings.Count(result["error"].(string), "failed to decrypt ejson") != 1 {
+		t.Fatalf("Bad error: %#v", result["error"])
+	}
+	target := respRead.Data["target_public_key"].(string)
+
+	publicKeys, err := storage.List(context.Background(), "keys/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The failed document is not retried until it is written again
+	for i := 0; i < 3; i++ {
+		if _, err := b.HandleRequest(context.Background(), reqRollback); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	retryKeys, err := storage.List(context.Background(), "keys/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(retryKeys) != len(publicKeys) {
+		t.Fatalf("key pairs generated for a failed document: \nGot: %#v\nWant: %#v", retryKeys, publicKeys)
+	}
+	respRetry := waitForRotation(t, b, storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56")
+	if !respRetry.Data["started_time"].(time.Time).Equal(respRead.Data["started_time"].(time.Time)) {
+		t.Fatalf("rotation of a failed document restarted: %#v", respRetry.Data)
+	}
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 2)
+	if _, err := b.HandleRequest(context.Background(), reqRollback); err != nil {
+		t.Fatal(err)
+	}
+
+	respRead = waitForRotation(t, b, storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56")
+	result = respRead.Data["documents"].(map[string]interface{})["itsasecret"].(map[string]interface{})
+	if result["status"] != "rotated" {
+		t.Fatalf("Bad result: %#v", result)
+	}
+	if respRead.Data["target_public_key"] != target {
+		t.Fatalf("Bad target: \nGot: %#v\nWant: %#v", respRead.Data["target_public_key"], target)
+	}
+}
@@ -114,3 +114,346 @@ func TestEJSON_Keys_Rotate_ExplicitDoc(t *testing.T) {
 		t.Fatalf("keypairs for the rotated document missing from storage")
 	}
 }
+
+func TestEJSON_Keys_Rotate_PublicKey(t *testing.T) {
+	b, storage := getTestBackend(t)
+	EJSON_Keys_Setup(t, b, storage)
+	publicKeys, err := storage.List(context.Background(), "keys/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inititialKeyCount := len(publicKeys)
+
+	targetKey := "f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f"
+	dataInput := map[string]interface{}{
+		ej.PublicKeyField: "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		"asecret":         "EJ[1:sdseJpJ3BpP9PO5Qs8IB4urmmYil46edSTek8SjgVGA=:zl7mkBzL4g2d0PE3hPucmfbDjf3aDK7K:iryi3H7wRGWvUI8kjfWLtP3sFiw=]",
+		"_bsecret":        "intentionally_left_unencrypted",
+		"anumber":         1,
+	}
+	dataInputBytes, err := json.Marshal(dataInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqRotate := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "rotate",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"document":   string(dataInputBytes),
+			"public_key": targetKey,
+		},
+	}
+
+	respRotate, err := b.HandleRequest(context.Background(), reqRotate)
+	if err != nil || (respRotate != nil && respRotate.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRotate)
+	}
+
+	rotatedDoc, ok := respRotate.Data["document"].(map[string]interface{})
+	if !ok {
+		t.Fatal("document missing from response", respRotate)
+	}
+	if rotatedDoc[ej.PublicKeyField] != targetKey {
+		t.Fatalf("Bad public key: \nGot: %#v\nWant: %#v", rotatedDoc[ej.PublicKeyField], targetKey)
+	}
+
+	rotatedData, err := MarshalForEjson(rotatedDoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decData, err := DecryptEjson(context.Background(), rotatedData, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decrypted map[string]interface{}
+	if err := json.Unmarshal(decData, &decrypted); err != nil {
+		t.Fatal(err)
+	}
+	if decrypted["asecret"] != "ohai" {
+		t.Fatalf("Bad decrypted secret: %#v", decrypted["asecret"])
+	}
+
+	publicKeys, err = storage.List(context.Background(), "keys/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(publicKeys) != inititialKeyCount {
+		t.Fatalf("key pair generated for a given public key: %#v", publicKeys)
+	}
+}
+
+func TestEJSON_Keys_Rotate_PublicKey_Invalid(t *testing.T) {
+	b, storage := getTestBackend(t)
+	EJSON_Keys_Setup(t, b, storage)
+	setKeyState(t, b, storage, "f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f", keyStateDecryptOnly)
+
+	publicKeys := []string{
+		"a5c0b19e7a8b2b7e0b0c0e3b47a6f2bde8f4d3b2f1e0c9d8b7a6f5e4d3c2b1a0",
+		"f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f",
+		"15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		"not-a-key",
+	}
+
+	for _, publicKey := range publicKeys {
+		reqRotate := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "rotate",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"document":   `{"_public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56", "asecret": "EJ[1:sdseJpJ3BpP9PO5Qs8IB4urmmYil46edSTek8SjgVGA=:zl7mkBzL4g2d0PE3hPucmfbDjf3aDK7K:iryi3H7wRGWvUI8kjfWLtP3sFiw=]"}`,
+				"public_key": publicKey,
+			},
+		}
+
+		respRotate, err := b.HandleRequest(context.Background(), reqRotate)
+		if err == nil && (respRotate == nil || !respRotate.IsError()) {
+			t.Fatalf("rotation to %s was not rejected: %#v", publicKey, respRotate)
+		}
+	}
+}
+
+func TestEJSON_Keys_Rotate_DryRun(t *testing.T) {
+	b, storage := getTestBackend(t)
+	EJSON_Keys_Setup(t, b, storage)
+	publicKeys, err := storage.List(context.Background(), "keys/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inititialKeyCount := len(publicKeys)
+
+	dataInput, err := EncryptEjsonDocument(context.Background(), map[string]interface{}{
+		ej.PublicKeyField: "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		"asecret":         "ohai",
+		"_bsecret":        "intentionally_left_unencrypted",
+		"anumber":         1,
+		"nested": map[string]interface{}{
+			"a/b":      "plain",
+			"_comment": "left alone",
+			"list":     []interface{}{"x", 2},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataInputBytes, err := json.Marshal(dataInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqRotate := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "rotate",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"document": string(dataInputBytes),
+			"dry_run":  true,
+		},
+	}
+
+	respRotate, err := b.HandleRequest(context.Background(), reqRotate)
+	if err != nil || (respRotate != nil && respRotate.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRotate)
+	}
+
+	expected := map[string]interface{}{
+		"public_key":   "",
+		"rotated_from": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		"fields": []string{
+			"/_public_key",
+			"/asecret",
+			"/nested/a~1b",
+			"/nested/list/0",
+		},
+	}
+	if !reflect.DeepEqual(respRotate.Data, expected) {
+		t.Fatalf("Bad dry run: \nGot: %#v\nWant: %#v", respRotate.Data, expected)
+	}
+
+	publicKeys, err = storage.List(context.Background(), "keys/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(publicKeys) != inititialKeyCount {
+		t.Fatalf("key pair generated by a dry run: %#v", publicKeys)
+	}
+}
+
+func TestEJSON_Keys_Rotate_RawParameters(t *testing.T) {
+	b, storage := getTestBackend(t)
+	EJSON_Keys_Setup(t, b, storage)
+	publicKeys, err := storage.List(context.Background(), "keys/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inititialKeyCount := len(publicKeys)
+
+	// A document field named like a parameter is not taken for one
+	reqRotate := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "rotate",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			ej.PublicKeyField: "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+			"asecret":         "EJ[1:sdseJpJ3BpP9PO5Qs8IB4urmmYil46edSTek8SjgVGA=:zl7mkBzL4g2d0PE3hPucmfbDjf3aDK7K:iryi3H7wRGWvUI8kjfWLtP3sFiw=]",
+			"dry_run":         true,
+		},
+	}
+
+	respRotate, err := b.HandleRequest(context.Background(), reqRotate)
+	if err != logical.ErrInvalidRequest || respRotate == nil || !respRotate.IsError() {
+		t.Fatalf("raw document with parameters was not rejected: err:%s resp:%#v\n", err, respRotate)
+	}
+
+	publicKeys, err = storage.List(context.Background(), "keys/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(publicKeys) != inititialKeyCount {
+		t.Fatalf("key pair generated for a rejected rotation: %#v", publicKeys)
+	}
+}
+
+func TestEJSON_Rotate_StoredDocument(t *testing.T) {
+	b, storage := getTestBackend(t)
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "team/itsasecret", 1)
+
+	reqRotate := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "team/itsasecret/rotate",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"cas": 1,
+		},
+	}
+
+	respRotate, err := b.HandleRequest(context.Background(), reqRotate)
+	if err != nil || (respRotate != nil && respRotate.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRotate)
+	}
+
+	publicKey := respRotate.Data["public_key"].(string)
+	if publicKey == "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56" {
+		t.Fatalf("public key did not change: %#v", publicKey)
+	}
+	if respRotate.Data["rotated_from"] != "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56" {
+		t.Fatalf("Bad rotated_from: %#v", respRotate.Data["rotated_from"])
+	}
+	if respRotate.Data["version"] != 2 {
+		t.Fatalf("Bad version: \nGot: %#v\nWant: %#v", respRotate.Data["version"], 2)
+	}
+	key, err := getKey(context.Background(), storage, publicKey)
+	if err != nil || key == nil {
+		t.Fatalf("new key pair not stored, err:%s key:%#v\n", err, key)
+	}
+
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "team/itsasecret/decrypted",
+		Storage:   storage,
+	}
+
+	respRead, err := b.HandleRequest(context.Background(), reqRead)
+	if err != nil || (respRead != nil && respRead.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRead)
+	}
+
+	dataDec := map[string]interface{}{
+		"asecret": "ohai",
+		"anumber": float64(1),
+	}
+	if !reflect.DeepEqual(respRead.Data["ejson"], dataDec) {
+		t.Fatalf("Bad decryption response: \nGot: %#v\nWant: %#v", respRead.Data["ejson"], dataDec)
+	}
+
+	reqMetadata := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "team/itsasecret/metadata",
+		Storage:   storage,
+	}
+
+	respMetadata, err := b.HandleRequest(context.Background(), reqMetadata)
+	if err != nil || (respMetadata != nil && respMetadata.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respMetadata)
+	}
+	version := respMetadata.Data["versions"].(map[string]interface{})["2"].(map[string]interface{})
+	if version["public_key"] != publicKey || version["rotated_from"] != "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56" {
+		t.Fatalf("Bad version metadata: %#v", version)
+	}
+
+	// Rotate again, to a given key
+	reqRotate.Data = map[string]interface{}{
+		"public_key": "f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f",
+	}
+
+	respRotate, err = b.HandleRequest(context.Background(), reqRotate)
+	if err != nil || (respRotate != nil && respRotate.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRotate)
+	}
+	if respRotate.Data["public_key"] != "f642c289deec898806d0482db64d468387b55adbbe8d278adf44f652ebd6eb0f" || respRotate.Data["rotated_from"] != publicKey {
+		t.Fatalf("Bad rotate response: %#v", respRotate.Data)
+	}
+
+	// The document is already encrypted with that key
+	respRotate, err = b.HandleRequest(context.Background(), reqRotate)
+	if err == nil {
+		t.Fatalf("expected rotation to the current key to be rejected, resp:%#v", respRotate)
+	}
+}
+
+func TestEJSON_Rotate_StoredDocument_Invalid(t *testing.T) {
+	b, storage := getTestBackend(t)
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+
+	reqRotate := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "itsasecret/rotate",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"public_key": "a5c0b19e7a8b2b7e0b0c0e3b47a6f2bde8f4d3b2f1e0c9d8b7a6f5e4d3c2b1a0",
+		},
+	}
+
+	respRotate, err := b.HandleRequest(context.Background(), reqRotate)
+	if err == nil {
+		t.Fatalf("expected rotation to an unknown key to be rejected, resp:%#v", respRotate)
+	}
+
+	reqRotate = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "nosecret/rotate",
+		Storage:   storage,
+	}
+
+	respRotate, err = b.HandleRequest(context.Background(), reqRotate)
+	if err != nil {
+		t.Fatalf("err:%s resp:%#v\n", err, respRotate)
+	}
+	if respRotate == nil || !respRotate.IsError() {
+		t.Fatalf("Rotated a document that does not exist: \n%#v", respRotate)
+	}
+
+	// Documents cannot be named like the rotation of another document
+	reqEncrypt := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "encrypt",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+			"path":       "itsasecret/rotate",
+			"ejson": map[string]interface{}{
+				"asecret": "ohai",
+			},
+		},
+	}
+
+	respEncrypt, err := b.HandleRequest(context.Background(), reqEncrypt)
+	if err == nil {
+		t.Fatalf("expected document name ending in rotate to be rejected, resp:%#v", respEncrypt)
+	}
+}
@@ -205,10 +205,712 @@ func TestEJSON_Data_List(t *testing.T) {
 	dataList := []string{
 		"itsasecret",
 		"itsasecret/",
-		"keys/",
 	}
 
 	if !reflect.DeepEqual(respList.Data["keys"], dataList) {
 		t.Fatalf("Bad list response: \nGot: %#v\nWant: %#v", respList.Data["keys"], dataList)
 	}
 }
+
+func TestEJSON_Data_Put_CAS(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	dataInput := map[string]interface{}{
+		"ejson": map[string]interface{}{
+			"_public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+			"asecret":     "EJ[1:sdseJpJ3BpP9PO5Qs8IB4urmmYil46edSTek8SjgVGA=:zl7mkBzL4g2d0PE3hPucmfbDjf3aDK7K:iryi3H7wRGWvUI8kjfWLtP3sFiw=]",
+			"anumber":     float64(1),
+		},
+		"cas": 0,
+	}
+
+	reqWrite := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "itsasecret",
+		Storage:   storage,
+		Data:      dataInput,
+	}
+
+	respWrite, err := b.HandleRequest(context.Background(), reqWrite)
+	if err != nil || (respWrite != nil && respWrite.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respWrite)
+	}
+
+	// cas=0 only allows creating the document
+	reqWrite.Operation = logical.UpdateOperation
+	respWrite, err = b.HandleRequest(context.Background(), reqWrite)
+	if err == nil || respWrite == nil || !respWrite.IsError() {
+		t.Fatalf("expected cas mismatch, resp:%#v", respWrite)
+	}
+
+	dataInput["cas"] = 1
+	respWrite, err = b.HandleRequest(context.Background(), reqWrite)
+	if err != nil || (respWrite != nil && respWrite.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respWrite)
+	}
+	if respWrite.Data["version"] != 2 {
+		t.Fatalf("Bad version: \nGot: %#v\nWant: %#v", respWrite.Data["version"], 2)
+	}
+}
+
+func TestEJSON_Data_Put_CASRequired(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	reqConfig := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"cas_required": true,
+		},
+	}
+
+	respConfig, err := b.HandleRequest(context.Background(), reqConfig)
+	if err != nil || (respConfig != nil && respConfig.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respConfig)
+	}
+
+	dataInput := map[string]interface{}{
+		"_public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		"asecret":     "EJ[1:sdseJpJ3BpP9PO5Qs8IB4urmmYil46edSTek8SjgVGA=:zl7mkBzL4g2d0PE3hPucmfbDjf3aDK7K:iryi3H7wRGWvUI8kjfWLtP3sFiw=]",
+		"anumber":     float64(1),
+	}
+
+	reqWrite := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "itsasecret",
+		Storage:   storage,
+		Data:      dataInput,
+	}
+
+	respWrite, err := b.HandleRequest(context.Background(), reqWrite)
+	if err == nil || respWrite == nil || !respWrite.IsError() {
+		t.Fatalf("expected write without cas to be rejected, resp:%#v", respWrite)
+	}
+
+	// Raw writes carry no parameters, cas is part of the document
+	dataInput["cas"] = 0
+	respWrite, err = b.HandleRequest(context.Background(), reqWrite)
+	if err == nil || respWrite == nil || !respWrite.IsError() {
+		t.Fatalf("expected raw write to be rejected, resp:%#v", respWrite)
+	}
+
+	delete(dataInput, "cas")
+	reqWrite.Data = map[string]interface{}{
+		"ejson": dataInput,
+		"cas":   0,
+	}
+	respWrite, err = b.HandleRequest(context.Background(), reqWrite)
+	if err != nil || (respWrite != nil && respWrite.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respWrite)
+	}
+
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "itsasecret",
+		Storage:   storage,
+	}
+
+	respRead, err := b.HandleRequest(context.Background(), reqRead)
+	if err != nil || (respRead != nil && respRead.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRead)
+	}
+
+	if _, ok := respRead.Data["ejson"].(map[string]interface{})["cas"]; ok {
+		t.Fatalf("cas parameter stored as part of the document: %#v", respRead.Data["ejson"])
+	}
+}
+
+func TestEJSON_Data_Put_RawParameters(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	// Keys named like the parameters of other operations belong to a raw
+	// document, whatever their value
+	dataInput := map[string]interface{}{
+		"_public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		"version":     "EJ[1:sdseJpJ3BpP9PO5Qs8IB4urmmYil46edSTek8SjgVGA=:zl7mkBzL4g2d0PE3hPucmfbDjf3aDK7K:iryi3H7wRGWvUI8kjfWLtP3sFiw=]",
+		"cas":         "EJ[1:sdseJpJ3BpP9PO5Qs8IB4urmmYil46edSTek8SjgVGA=:zl7mkBzL4g2d0PE3hPucmfbDjf3aDK7K:iryi3H7wRGWvUI8kjfWLtP3sFiw=]",
+		"limit":       map[string]interface{}{"_max": float64(10)},
+		"recursive":   []interface{}{float64(1), float64(2)},
+		"labels":      float64(3),
+		"field":       true,
+	}
+
+	reqWrite := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "itsasecret",
+		Storage:   storage,
+		Data:      dataInput,
+	}
+
+	respWrite, err := b.HandleRequest(context.Background(), reqWrite)
+	if err != nil || (respWrite != nil && respWrite.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respWrite)
+	}
+	if respWrite.Data["version"] != 1 {
+		t.Fatalf("Bad version: \nGot: %#v\nWant: %#v", respWrite.Data["version"], 1)
+	}
+
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "itsasecret/decrypted",
+		Storage:   storage,
+	}
+
+	respRead, err := b.HandleRequest(context.Background(), reqRead)
+	if err != nil || (respRead != nil && respRead.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRead)
+	}
+
+	expected := map[string]interface{}{
+		"version":   "ohai",
+		"cas":       "ohai",
+		"limit":     map[string]interface{}{"_max": float64(10)},
+		"recursive": []interface{}{float64(1), float64(2)},
+		"labels":    float64(3),
+		"field":     true,
+	}
+	if !reflect.DeepEqual(respRead.Data["ejson"], expected) {
+		t.Fatalf("Bad document: \nGot: %#v\nWant: %#v", respRead.Data["ejson"], expected)
+	}
+}
+
+func TestEJSON_Data_Get_LazyDecryption(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+
+	reqConfig := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"decryption_mode": "lazy",
+		},
+	}
+
+	respConfig, err := b.HandleRequest(context.Background(), reqConfig)
+	if err != nil || (respConfig != nil && respConfig.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respConfig)
+	}
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 2)
+
+	for _, key := range []string{"docs/itsasecret/decrypted", "docs/itsasecret/versions/1/decrypted", "docs/itsasecret/versions/2/decrypted"} {
+		entry, err := storage.Get(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry != nil {
+			t.Fatalf("plaintext stored at %s with lazy decryption", key)
+		}
+	}
+
+	reqReadDec := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "itsasecret/decrypted",
+		Storage:   storage,
+	}
+
+	respReadDec, err := b.HandleRequest(context.Background(), reqReadDec)
+	if err != nil || (respReadDec != nil && respReadDec.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respReadDec)
+	}
+
+	dataDec := map[string]interface{}{
+		"asecret": "ohai",
+		"anumber": float64(2),
+	}
+
+	if !reflect.DeepEqual(respReadDec.Data["ejson"], dataDec) {
+		t.Fatalf("Bad decryption response: \nGot: %#v\nWant: %#v", respReadDec.Data["ejson"], dataDec)
+	}
+
+	reqConfig.Data["decryption_mode"] = "stored"
+	respConfig, err = b.HandleRequest(context.Background(), reqConfig)
+	if err != nil || (respConfig != nil && respConfig.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respConfig)
+	}
+
+	entry, err := storage.Get(context.Background(), "docs/itsasecret/versions/1/decrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil {
+		t.Fatal("plaintext not restored when switching back to stored decryption")
+	}
+}
+
+func TestEJSON_Data_List_Recursive(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	for _, path := range []string{"itsasecret", "payments/prod", "payments/staging", "payments/eu/prod"} {
+		EJSON_Document_Write(t, b, storage, path, 1)
+	}
+
+	reqKeyPair := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "keypair",
+		Storage:   storage,
+	}
+
+	respKeyPair, err := b.HandleRequest(context.Background(), reqKeyPair)
+	if err != nil || (respKeyPair != nil && respKeyPair.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respKeyPair)
+	}
+	otherPublicKey := respKeyPair.Data["public"].(string)
+
+	otherDoc, err := EncryptEjsonDocument(context.Background(), map[string]interface{}{
+		"_public_key": otherPublicKey,
+		"asecret":     "ohai",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqOther := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "other",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"ejson": otherDoc,
+		},
+	}
+
+	respOther, err := b.HandleRequest(context.Background(), reqOther)
+	if err != nil || (respOther != nil && respOther.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respOther)
+	}
+
+	reqMeta := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "payments/prod/metadata",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"labels": map[string]interface{}{
+				"env": "production",
+			},
+		},
+	}
+
+	respMeta, err := b.HandleRequest(context.Background(), reqMeta)
+	if err != nil || (respMeta != nil && respMeta.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respMeta)
+	}
+
+	cases := []struct {
+		path string
+		data map[string]interface{}
+		want []string
+	}{
+		{
+			path: "",
+			data: map[string]interface{}{},
+			want: []string{"itsasecret", "other", "payments/eu/prod", "payments/prod", "payments/staging"},
+		},
+		{
+			path: "payments/",
+			data: map[string]interface{}{},
+			want: []string{"eu/prod", "prod", "staging"},
+		},
+		{
+			path: "",
+			data: map[string]interface{}{"prefix": "pay", "limit": 2},
+			want: []string{"payments/eu/prod", "payments/prod"},
+		},
+		{
+			path: "",
+			data: map[string]interface{}{"after": "payments/prod"},
+			want: []string{"payments/staging"},
+		},
+		{
+			path: "",
+			data: map[string]interface{}{"labels": "env=production"},
+			want: []string{"payments/prod"},
+		},
+		{
+			path: "",
+			data: map[string]interface{}{"public_key": otherPublicKey},
+			want: []string{"other"},
+		},
+	}
+
+	for _, c := range cases {
+		c.data["recursive"] = true
+		reqList := &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      c.path,
+			Storage:   storage,
+			Data:      c.data,
+		}
+
+		respList, err := b.HandleRequest(context.Background(), reqList)
+		if err != nil || (respList != nil && respList.IsError()) {
+			t.Fatalf("err:%s resp:%#v\n", err, respList)
+		}
+
+		if !reflect.DeepEqual(respList.Data["keys"], c.want) {
+			t.Fatalf("Bad list response for %#v: \nGot: %#v\nWant: %#v", c.data, respList.Data["keys"], c.want)
+		}
+	}
+}
+
+func TestEJSON_Data_Get_UnderscorePolicy(t *testing.T) {
+	document := map[string]interface{}{
+		"_public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		"_bsecret":    "orly",
+		"database": map[string]interface{}{
+			"_username": "admin",
+			"password":  "sicher",
+		},
+	}
+
+	cases := map[string]map[string]interface{}{
+		"top_level": {
+			"bsecret": "orly",
+			"database": map[string]interface{}{
+				"_username": "admin",
+				"password":  "sicher",
+			},
+		},
+		"all": {
+			"bsecret": "orly",
+			"database": map[string]interface{}{
+				"username": "admin",
+				"password": "sicher",
+			},
+		},
+		"none": {
+			"_bsecret": "orly",
+			"database": map[string]interface{}{
+				"_username": "admin",
+				"password":  "sicher",
+			},
+		},
+	}
+
+	for policy, dataDec := range cases {
+		b, storage := getTestBackend(t)
+
+		EJSON_Keys_Setup(t, b, storage)
+
+		reqConfig := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "config",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"underscore_policy": policy,
+			},
+		}
+
+		respConfig, err := b.HandleRequest(context.Background(), reqConfig)
+		if err != nil || (respConfig != nil && respConfig.IsError()) {
+			t.Fatalf("err:%s resp:%#v\n", err, respConfig)
+		}
+
+		encDoc, err := EncryptEjsonDocument(context.Background(), document)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reqWrite := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "itsasecret",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"ejson": encDoc,
+			},
+		}
+
+		respWrite, err := b.HandleRequest(context.Background(), reqWrite)
+		if err != nil || (respWrite != nil && respWrite.IsError()) {
+			t.Fatalf("err:%s resp:%#v\n", err, respWrite)
+		}
+
+		reqReadDec := &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "itsasecret/decrypted",
+			Storage:   storage,
+		}
+
+		respReadDec, err := b.HandleRequest(context.Background(), reqReadDec)
+		if err != nil || (respReadDec != nil && respReadDec.IsError()) {
+			t.Fatalf("err:%s resp:%#v\n", err, respReadDec)
+		}
+
+		if !reflect.DeepEqual(respReadDec.Data["ejson"], dataDec) {
+			t.Fatalf("Bad decryption response for %s: \nGot: %#v\nWant: %#v", policy, respReadDec.Data["ejson"], dataDec)
+		}
+	}
+}
+
+func TestEJSON_Data_Put_UnderscoreCollision(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	encDoc, err := EncryptEjsonDocument(context.Background(), map[string]interface{}{
+		"_public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		"_bsecret":    "orly",
+		"bsecret":     "yarly",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqWrite := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "itsasecret",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"ejson": encDoc,
+		},
+	}
+
+	respWrite, err := b.HandleRequest(context.Background(), reqWrite)
+	if err == nil {
+		t.Fatalf("expected colliding keys to be rejected, resp:%#v", respWrite)
+	}
+}
+
+func TestEJSON_Data_Put_DocsPrefix(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	// Documents named like a backend operation are reachable below docs/
+	EJSON_Document_Write(t, b, storage, "docs/rotate", 1)
+
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "docs/rotate/decrypted",
+		Storage:   storage,
+	}
+
+	respRead, err := b.HandleRequest(context.Background(), reqRead)
+	if err != nil || (respRead != nil && respRead.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRead)
+	}
+
+	dataDec := map[string]interface{}{
+		"asecret": "ohai",
+		"anumber": float64(1),
+	}
+	if !reflect.DeepEqual(respRead.Data["ejson"], dataDec) {
+		t.Fatalf("Bad decryption response: \nGot: %#v\nWant: %#v", respRead.Data["ejson"], dataDec)
+	}
+
+	entry, err := storage.Get(context.Background(), "docs/rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil {
+		t.Fatalf("document not stored below docs/")
+	}
+}
+
+func TestEJSON_Data_DocsPrefix_Canonical(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+	EJSON_Document_Write(t, b, storage, "docs/rotate", 1)
+	EJSON_Document_Write(t, b, storage, "docs/keys/foo", 1)
+
+	// Every document is only reachable by a single path, so that policies on
+	// it cannot be bypassed
+	reqs := []*logical.Request{
+		{Operation: logical.ReadOperation, Path: "docs/itsasecret"},
+		{Operation: logical.ReadOperation, Path: "docs/itsasecret/decrypted"},
+		{Operation: logical.ReadOperation, Path: "docs/itsasecret/decrypted/field/asecret"},
+		{Operation: logical.ReadOperation, Path: "docs/itsasecret/metadata"},
+		{Operation: logical.ListOperation, Path: "docs/itsasecret/versions/"},
+		{Operation: logical.UpdateOperation, Path: "docs/itsasecret/patch", Data: map[string]interface{}{"ejson": map[string]interface{}{"bsecret": "yarly"}}},
+		{Operation: logical.DeleteOperation, Path: "docs/itsasecret"},
+		{Operation: logical.ListOperation, Path: "docs/"},
+		{Operation: logical.ReadOperation, Path: "rotate/decrypted"},
+		{Operation: logical.ReadOperation, Path: "rotate/metadata"},
+	}
+
+	for _, req := range reqs {
+		req.Storage = storage
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("%s of %s was not rejected: %#v", req.Operation, req.Path, resp)
+		}
+	}
+
+	for _, path := range []string{"itsasecret/decrypted", "docs/rotate/decrypted", "docs/keys/foo/decrypted"} {
+		reqRead := &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      path,
+			Storage:   storage,
+		}
+
+		respRead, err := b.HandleRequest(context.Background(), reqRead)
+		if err != nil || (respRead != nil && respRead.IsError()) {
+			t.Fatalf("err:%s resp:%#v\n", err, respRead)
+		}
+	}
+}
+
+func TestEJSON_Data_Put_ReservedName(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	for _, path := range []string{"foo/decrypted/bar", "foo/versions/1", "rollback/foo", "foo//bar"} {
+		reqWrite := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"asecret": "ohai",
+			},
+		}
+
+		respWrite, err := b.HandleRequest(context.Background(), reqWrite)
+		if err == nil {
+			t.Fatalf("expected document name %s to be rejected, resp:%#v", path, respWrite)
+		}
+	}
+}
+
+func TestEJSON_Data_NamespaceMigration(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+
+	// Move the document back to the root of the mount, where older mounts kept it
+	if err := storage.Delete(context.Background(), "namespace_migration"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"itsasecret", "itsasecret/decrypted", "itsasecret/metadata", "itsasecret/versions/1", "itsasecret/versions/1/decrypted"} {
+		entry, err := storage.Get(context.Background(), "docs/"+key)
+		if err != nil || entry == nil {
+			t.Fatalf("err:%s entry:%#v\n", err, entry)
+		}
+		if err := storage.Put(context.Background(), &logical.StorageEntry{Key: key, Value: entry.Value}); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Delete(context.Background(), "docs/"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Initialize(context.Background(), &logical.InitializationRequest{Storage: storage}); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := storage.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKeys := []string{"docs/", "index/", "keys/", "namespace_migration"}
+	if !reflect.DeepEqual(keys, dataKeys) {
+		t.Fatalf("Bad storage keys after migration: \nGot: %#v\nWant: %#v", keys, dataKeys)
+	}
+
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "itsasecret/decrypted",
+		Storage:   storage,
+	}
+
+	respRead, err := b.HandleRequest(context.Background(), reqRead)
+	if err != nil || (respRead != nil && respRead.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRead)
+	}
+
+	if respRead.Data["ejson"].(map[string]interface{})["asecret"] != "ohai" {
+		t.Fatalf("Bad decryption response after migration: %#v", respRead.Data["ejson"])
+	}
+}
+
+func TestEJSON_Data_NamespaceMigration_BackendNames(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+
+	encrypted, err := storage.Get(context.Background(), "docs/itsasecret")
+	if err != nil || encrypted == nil {
+		t.Fatalf("err:%s entry:%#v\n", err, encrypted)
+	}
+	decrypted, err := storage.Get(context.Background(), "docs/itsasecret/decrypted")
+	if err != nil || decrypted == nil {
+		t.Fatalf("err:%s entry:%#v\n", err, decrypted)
+	}
+
+	// Older mounts only kept keys and documents, stored at the root of the
+	// mount, whatever their names
+	for _, prefix := range []string{"docs/", "index/"} {
+		if err := logical.ClearView(context.Background(), logical.NewStorageView(storage, prefix)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.Delete(context.Background(), "namespace_migration"); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"config", "index/foo", "rotation/bar", "docs/baz", "docs", "baz", "namespace_migration"}
+	for _, name := range names {
+		for key, value := range map[string][]byte{name: encrypted.Value, name + "/decrypted": decrypted.Value} {
+			if err := storage.Put(context.Background(), &logical.StorageEntry{Key: key, Value: value}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// A second start finds the migration done and leaves the documents alone
+	for i := 0; i < 2; i++ {
+		if err := b.Initialize(context.Background(), &logical.InitializationRequest{Storage: storage}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths := []string{"docs/config", "index/foo", "rotation/bar", "docs/docs/baz", "docs/docs", "baz", "namespace_migration"}
+	for _, path := range paths {
+		reqRead := &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      path + "/decrypted",
+			Storage:   storage,
+		}
+
+		respRead, err := b.HandleRequest(context.Background(), reqRead)
+		if err != nil || (respRead != nil && respRead.IsError()) {
+			t.Fatalf("read of %s failed: err:%s resp:%#v\n", path, err, respRead)
+		}
+
+		if respRead.Data["ejson"].(map[string]interface{})["asecret"] != "ohai" {
+			t.Fatalf("Bad decryption response of %s after migration: %#v", path, respRead.Data["ejson"])
+		}
+	}
+
+	reqConfig := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config",
+		Storage:   storage,
+	}
+
+	respConfig, err := b.HandleRequest(context.Background(), reqConfig)
+	if err != nil || (respConfig != nil && respConfig.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respConfig)
+	}
+	if _, ok := respConfig.Data["ejson"]; ok {
+		t.Fatalf("Document read as the config of the mount: %#v", respConfig.Data)
+	}
+}
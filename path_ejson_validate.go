@@ -0,0 +1,161 @@
+package secretsejson
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/ejson/crypto"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// validationOK marks a value or public key that is in order.
+	validationOK = "ok"
+	// validationPlaintextLeak marks a value that should be encrypted but is not.
+	validationPlaintextLeak = "plaintext_leak"
+	// validationUndecryptable marks a value that does not decrypt with the
+	// private key of the document.
+	validationUndecryptable = "undecryptable"
+	// validationUnknownKey marks a public key that is missing or not stored in
+	// keys/, and every encrypted value that can therefore not be checked.
+	validationUnknownKey = "unknown_key"
+	// validationArchivedKey marks a public key whose key pair is archived and
+	// no longer decrypts, and every encrypted value that can therefore not be
+	// checked.
+	validationArchivedKey = "archived_key"
+)
+
+func ejsonValidatePaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "validate",
+			Fields: map[string]*framework.FieldSchema{
+				"ejson": {
+					Type:        framework.TypeMap,
+					Description: "EJSON document to validate",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.validate,
+				logical.UpdateOperation: b.validate,
+			},
+		},
+	}
+}
+
+// validate reports, field by field, whether an ejson document is fully
+// encrypted with a known key. Plaintext is never part of the report.
+func (b *backend) validate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	inputData, ok := data.GetOk("ejson")
+	if !ok {
+		if len(data.Raw) == 0 {
+			return logical.ErrorResponse("no data provided"), logical.ErrInvalidRequest
+		}
+		inputData = data.Raw
+	}
+
+	encData, err := MarshalInput(inputData)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to marshall json: {{err}}", err)
+	}
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(encData, &doc); err != nil {
+		return nil, errwrap.Wrapf("failed to marshall json: {{err}}", err)
+	}
+
+	publicKey, _ := doc["_public_key"].(string)
+	decrypter, keyStatus, err := b.validationDecrypter(ctx, req.Storage, publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]interface{}{}
+	validateValue(decrypter, keyStatus, doc, "", false, fields)
+
+	valid := keyStatus == validationOK
+	for _, status := range fields {
+		if status != validationOK {
+			valid = false
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"valid":      valid,
+			"public_key": keyStatus,
+			"fields":     fields,
+		},
+	}, nil
+}
+
+// validationDecrypter returns a decrypter for the private key of publicKey
+// and the status of the key, the decrypter is nil unless the key is stored in
+// keys/ and may decrypt.
+func (b *backend) validationDecrypter(ctx context.Context, s logical.Storage, publicKey string) (*crypto.Decrypter, string, error) {
+	if _, err := ParseKey(publicKey); err != nil {
+		return nil, validationUnknownKey, nil
+	}
+
+	key, err := getKey(ctx, s, publicKey)
+	if err != nil {
+		return nil, "", err
+	}
+	if key == nil {
+		return nil, validationUnknownKey, nil
+	}
+	if !key.canDecrypt() {
+		return nil, validationArchivedKey, nil
+	}
+	// Like ejson, tolerate whitespace around keys stored by older versions.
+	// The error of ParseKey would repeat the private key.
+	private, err := ParseKey(strings.TrimSpace(key.Private))
+	if err != nil {
+		return nil, "", fmt.Errorf("undecryptable key %s", publicKey)
+	}
+
+	kp := &crypto.Keypair{Private: private}
+	return kp.Decrypter(), validationOK, nil
+}
+
+// pointerToken escapes a key for use in a JSON pointer.
+func pointerToken(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
+
+// validateValue records the status of every string ejson would encrypt in
+// value, keyed by its JSON pointer. Like ejson, strings directly below a key
+// starting with an underscore are left alone. Without a decrypter, encrypted
+// strings take the status of the key.
+func validateValue(decrypter *crypto.Decrypter, keyStatus string, value interface{}, pointer string, underscored bool, fields map[string]interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			validateValue(decrypter, keyStatus, child, pointer+"/"+pointerToken(k), strings.HasPrefix(k, "_"), fields)
+		}
+	case []interface{}:
+		for i, child := range v {
+			validateValue(decrypter, keyStatus, child, pointer+"/"+strconv.Itoa(i), underscored, fields)
+		}
+	case string:
+		if underscored {
+			return
+		}
+		switch {
+		case !crypto.IsBoxedMessage([]byte(v)):
+			fields[pointer] = validationPlaintextLeak
+		case decrypter == nil:
+			fields[pointer] = keyStatus
+		default:
+			if _, err := decrypter.Decrypt([]byte(v)); err != nil {
+				fields[pointer] = validationUndecryptable
+			} else {
+				fields[pointer] = validationOK
+			}
+		}
+	}
+}
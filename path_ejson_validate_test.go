@@ -0,0 +1,182 @@
+package secretsejson
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/ejson"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestEJSON_Validate(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	// A value encrypted for a different key than the document's
+	otherPublic, _, err := ejson.GenerateKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherBoxed, err := EncryptEjsonValues(context.Background(), otherPublic, []string{"replica"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataInput := map[string]interface{}{
+		"_public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		"asecret":     "EJ[1:sdseJpJ3BpP9PO5Qs8IB4urmmYil46edSTek8SjgVGA=:zl7mkBzL4g2d0PE3hPucmfbDjf3aDK7K:iryi3H7wRGWvUI8kjfWLtP3sFiw=]",
+		"_bsecret":    "intentionally_left_unencrypted",
+		"anumber":     1,
+		"database": map[string]interface{}{
+			"password": "hunter2",
+			"hosts":    []interface{}{otherBoxed[0]},
+		},
+	}
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "validate",
+		Storage:   storage,
+		Data:      dataInput,
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	dataReport := map[string]interface{}{
+		"valid":      false,
+		"public_key": "ok",
+		"fields": map[string]interface{}{
+			"/asecret":           "ok",
+			"/database/password": "plaintext_leak",
+			"/database/hosts/0":  "undecryptable",
+		},
+	}
+	if !reflect.DeepEqual(resp.Data, dataReport) {
+		t.Fatalf("Bad validation report: \nGot: %#v\nWant: %#v", resp.Data, dataReport)
+	}
+}
+
+func TestEJSON_Validate_UnknownKey(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	dataInput := map[string]interface{}{
+		"_public_key": "a5c0b19e7a8b2b7e0b0c0e3b47a6f2bde8f4d3b2f1e0c9d8b7a6f5e4d3c2b1a0",
+		"asecret":     "EJ[1:sdseJpJ3BpP9PO5Qs8IB4urmmYil46edSTek8SjgVGA=:zl7mkBzL4g2d0PE3hPucmfbDjf3aDK7K:iryi3H7wRGWvUI8kjfWLtP3sFiw=]",
+	}
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "validate",
+		Storage:   storage,
+		Data:      dataInput,
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	dataReport := map[string]interface{}{
+		"valid":      false,
+		"public_key": "unknown_key",
+		"fields": map[string]interface{}{
+			"/asecret": "unknown_key",
+		},
+	}
+	if !reflect.DeepEqual(resp.Data, dataReport) {
+		t.Fatalf("Bad validation report: \nGot: %#v\nWant: %#v", resp.Data, dataReport)
+	}
+}
+
+func TestEJSON_Validate_ArchivedKey(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+	setKeyState(t, b, storage, "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56", "archived")
+
+	dataInput := map[string]interface{}{
+		"_public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		"asecret":     "EJ[1:sdseJpJ3BpP9PO5Qs8IB4urmmYil46edSTek8SjgVGA=:zl7mkBzL4g2d0PE3hPucmfbDjf3aDK7K:iryi3H7wRGWvUI8kjfWLtP3sFiw=]",
+	}
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "validate",
+		Storage:   storage,
+		Data:      dataInput,
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	dataReport := map[string]interface{}{
+		"valid":      false,
+		"public_key": "archived_key",
+		"fields": map[string]interface{}{
+			"/asecret": "archived_key",
+		},
+	}
+	if !reflect.DeepEqual(resp.Data, dataReport) {
+		t.Fatalf("Bad validation report: \nGot: %#v\nWant: %#v", resp.Data, dataReport)
+	}
+}
+
+func TestEJSON_Validate_LegacyKey(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	dataInput := map[string]interface{}{
+		"_public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		"asecret":     "EJ[1:sdseJpJ3BpP9PO5Qs8IB4urmmYil46edSTek8SjgVGA=:zl7mkBzL4g2d0PE3hPucmfbDjf3aDK7K:iryi3H7wRGWvUI8kjfWLtP3sFiw=]",
+	}
+
+	// Older versions stored the private key as written, surrounding whitespace
+	// included, which decrypt tolerates
+	if err := storage.Put(context.Background(), &logical.StorageEntry{
+		Key:   "keys/15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		Value: []byte("37124bcf00c2d9fd87ddd596162d99c004460fd47130f2d653e45f85a0681cf0\n"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "validate",
+		Storage:   storage,
+		Data:      dataInput,
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+	if resp.Data["valid"] != true {
+		t.Fatalf("Bad validation report: %#v", resp.Data)
+	}
+
+	// A stored key that cannot be parsed is not repeated in the error
+	if err := storage.Put(context.Background(), &logical.StorageEntry{
+		Key:   "keys/15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+		Value: []byte("37124bcf00c2d9fd87ddd596162d99c004460fd47130f2d653e45f85a0681c"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err == nil {
+		t.Fatalf("validation with an unparseable key succeeded: %#v", resp)
+	}
+	if strings.Contains(err.Error(), "37124bcf") || (resp != nil && strings.Contains(fmt.Sprint(resp.Data), "37124bcf")) {
+		t.Fatalf("private key returned in error: %s resp:%#v", err, resp)
+	}
+}
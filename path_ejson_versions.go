@@ -0,0 +1,127 @@
+package secretsejson
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func ejsonVersionsPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: documentPattern(".+", "/versions/?"),
+			Fields: map[string]*framework.FieldSchema{
+				"path": {
+					Type:        framework.TypeString,
+					Description: "Path of the stored document",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.versionsList,
+			},
+		},
+		{
+			Pattern: documentPattern(".+", "/rollback"),
+			Fields: map[string]*framework.FieldSchema{
+				"path": {
+					Type:        framework.TypeString,
+					Description: "Path of the stored document",
+				},
+				"version": {
+					Type:        framework.TypeInt,
+					Description: "Version to promote to the current version",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.rollback,
+				logical.UpdateOperation: b.rollback,
+			},
+		},
+	}
+}
+
+func (b *backend) versionsList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("path").(string)
+	if resp, err := b.checkDocumentPath(req, name); resp != nil || err != nil {
+		return resp, err
+	}
+	path := documentKey(name)
+
+	meta, err := getDocumentMetadata(ctx, req.Storage, path)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return logical.ErrorResponse(fmt.Sprintf("failed to find versions of %s", name)), nil
+	}
+
+	versions := make([]int, 0, len(meta.Versions))
+	for version := range meta.Versions {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+
+	keys := make([]string, 0, len(versions))
+	keyInfo := map[string]interface{}{}
+	for _, version := range versions {
+		key := strconv.Itoa(version)
+		keys = append(keys, key)
+		keyInfo[key] = map[string]interface{}{
+			"created_time": meta.Versions[version].CreatedTime,
+			"current":      version == meta.CurrentVersion,
+		}
+	}
+
+	return logical.ListResponseWithInfo(keys, keyInfo), nil
+}
+
+func (b *backend) rollback(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("path").(string)
+	if resp, err := b.checkDocumentPath(req, name); resp != nil || err != nil {
+		return resp, err
+	}
+	path := documentKey(name)
+	version := data.Get("version").(int)
+	if version <= 0 {
+		return logical.ErrorResponse("no version provided"), logical.ErrInvalidRequest
+	}
+
+	unlock := b.lockDocument(path)
+	defer unlock()
+
+	meta, err := getDocumentMetadata(ctx, req.Storage, path)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil || meta.Versions[version] == nil {
+		return logical.ErrorResponse(fmt.Sprintf("failed to find version %d of %s", version, name)), nil
+	}
+
+	encEntry, err := req.Storage.Get(ctx, versionKey(path, version))
+	if err != nil {
+		return nil, err
+	}
+	sanData, err := b.readPlaintext(ctx, req.Storage, versionKey(path, version))
+	if err != nil {
+		return nil, err
+	}
+	if encEntry == nil || sanData == nil {
+		return logical.ErrorResponse(fmt.Sprintf("failed to find version %d of %s", version, name)), nil
+	}
+
+	b.Logger().Info("rolling back document", "path", name, "version", version)
+	meta, err = b.storeDocument(ctx, req, path, encEntry.Value, sanData, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"version": meta.CurrentVersion,
+		},
+	}, nil
+}
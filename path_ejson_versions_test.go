@@ -0,0 +1,182 @@
+package secretsejson
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func EJSON_Document_Write(t *testing.T, b logical.Backend, storage logical.Storage, path string, anumber int) *logical.Response {
+	dataInput := map[string]interface{}{
+		"ejson": map[string]interface{}{
+			"_public_key": "15838c2f3260185ad2a8e1298bd507479ff2470b9e9c1fd89e0fdfefe2959f56",
+			"asecret":     "EJ[1:sdseJpJ3BpP9PO5Qs8IB4urmmYil46edSTek8SjgVGA=:zl7mkBzL4g2d0PE3hPucmfbDjf3aDK7K:iryi3H7wRGWvUI8kjfWLtP3sFiw=]",
+			"anumber":     float64(anumber),
+		},
+	}
+
+	reqWrite := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      path,
+		Storage:   storage,
+		Data:      dataInput,
+	}
+
+	respWrite, err := b.HandleRequest(context.Background(), reqWrite)
+	if err != nil || (respWrite != nil && respWrite.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respWrite)
+	}
+	return respWrite
+}
+
+func TestEJSON_Versions_List(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	for i := 1; i <= 3; i++ {
+		respWrite := EJSON_Document_Write(t, b, storage, "itsasecret", i)
+		if respWrite.Data["version"] != i {
+			t.Fatalf("Bad version: \nGot: %#v\nWant: %#v", respWrite.Data["version"], i)
+		}
+	}
+
+	reqList := &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "itsasecret/versions/",
+		Storage:   storage,
+	}
+
+	respList, err := b.HandleRequest(context.Background(), reqList)
+	if err != nil || (respList != nil && respList.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respList)
+	}
+
+	dataList := []string{"1", "2", "3"}
+	if !reflect.DeepEqual(respList.Data["keys"], dataList) {
+		t.Fatalf("Bad list response: \nGot: %#v\nWant: %#v", respList.Data["keys"], dataList)
+	}
+}
+
+func TestEJSON_Versions_Read(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+	EJSON_Document_Write(t, b, storage, "itsasecret", 2)
+
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "itsasecret/decrypted",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"version": 1,
+		},
+	}
+
+	respRead, err := b.HandleRequest(context.Background(), reqRead)
+	if err != nil || (respRead != nil && respRead.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRead)
+	}
+
+	dataDec := map[string]interface{}{
+		"asecret": "ohai",
+		"anumber": float64(1),
+	}
+	if !reflect.DeepEqual(respRead.Data["ejson"], dataDec) {
+		t.Fatalf("Bad decryption response: \nGot: %#v\nWant: %#v", respRead.Data["ejson"], dataDec)
+	}
+}
+
+func TestEJSON_Versions_Rollback(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	EJSON_Document_Write(t, b, storage, "itsasecret", 1)
+	EJSON_Document_Write(t, b, storage, "itsasecret", 2)
+
+	reqRollback := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "itsasecret/rollback",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"version": 1,
+		},
+	}
+
+	respRollback, err := b.HandleRequest(context.Background(), reqRollback)
+	if err != nil || (respRollback != nil && respRollback.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRollback)
+	}
+	if respRollback.Data["version"] != 3 {
+		t.Fatalf("Bad version: \nGot: %#v\nWant: %#v", respRollback.Data["version"], 3)
+	}
+
+	reqRead := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "itsasecret/decrypted",
+		Storage:   storage,
+	}
+
+	respRead, err := b.HandleRequest(context.Background(), reqRead)
+	if err != nil || (respRead != nil && respRead.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respRead)
+	}
+
+	anumber := respRead.Data["ejson"].(map[string]interface{})["anumber"]
+	if anumber != float64(1) {
+		t.Fatalf("Bad rollback: \nGot: %#v\nWant: %#v", anumber, float64(1))
+	}
+}
+
+func TestEJSON_Versions_MaxVersions(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	EJSON_Keys_Setup(t, b, storage)
+
+	reqConfig := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"max_versions": 2,
+		},
+	}
+
+	respConfig, err := b.HandleRequest(context.Background(), reqConfig)
+	if err != nil || (respConfig != nil && respConfig.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respConfig)
+	}
+
+	for i := 1; i <= 4; i++ {
+		EJSON_Document_Write(t, b, storage, "itsasecret", i)
+	}
+
+	reqList := &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "itsasecret/versions/",
+		Storage:   storage,
+	}
+
+	respList, err := b.HandleRequest(context.Background(), reqList)
+	if err != nil || (respList != nil && respList.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, respList)
+	}
+
+	dataList := []string{"3", "4"}
+	if !reflect.DeepEqual(respList.Data["keys"], dataList) {
+		t.Fatalf("Bad list response: \nGot: %#v\nWant: %#v", respList.Data["keys"], dataList)
+	}
+
+	entry, err := storage.Get(context.Background(), "docs/itsasecret/versions/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry != nil {
+		t.Fatalf("pruned version still in storage: %#v", entry)
+	}
+}